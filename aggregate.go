@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aggregateBatch collects webhooks for one event until its window closes.
+type aggregateBatch struct {
+	webhooks  []PretixWebhook
+	recordIDs []int64
+	timer     *time.Timer
+}
+
+// webhookAggregator coalesces bursts of webhooks for the same event into a
+// single notification. The first webhook for an event opens a window; every
+// matching webhook arriving before it closes joins the same batch.
+type webhookAggregator struct {
+	window  time.Duration
+	actions []string
+
+	mu      sync.Mutex
+	batches map[string]*aggregateBatch
+	flushes sync.WaitGroup
+}
+
+func newWebhookAggregator(window time.Duration, actions []string) *webhookAggregator {
+	return &webhookAggregator{
+		window:  window,
+		actions: actions,
+		batches: make(map[string]*aggregateBatch),
+	}
+}
+
+// add buffers the webhook when its action is aggregated. It returns false
+// when the caller should deliver the webhook itself.
+func (a *webhookAggregator) add(ctx context.Context, webhook PretixWebhook, recordID int64) bool {
+	aggregated := false
+	for _, pattern := range a.actions {
+		if matchAction(pattern, webhook.Action) {
+			aggregated = true
+			break
+		}
+	}
+	if !aggregated {
+		return false
+	}
+
+	key := webhook.Organizer + "/" + webhook.Event
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	batch, ok := a.batches[key]
+	if !ok {
+		batch = &aggregateBatch{}
+		a.flushes.Add(1)
+		batch.timer = time.AfterFunc(a.window, func() {
+			defer a.flushes.Done()
+			a.flush(key)
+		})
+		a.batches[key] = batch
+	}
+	batch.webhooks = append(batch.webhooks, webhook)
+	batch.recordIDs = append(batch.recordIDs, recordID)
+
+	slog.DebugContext(ctx, "Webhook buffered for aggregation",
+		append(webhookAttrs(webhook), "pending", len(batch.webhooks))...)
+	return true
+}
+
+// flush delivers the batch for key, either as the original notification when
+// it holds a single webhook or as one aggregated notification.
+func (a *webhookAggregator) flush(key string) {
+	a.mu.Lock()
+	batch, ok := a.batches[key]
+	delete(a.batches, key)
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	if len(batch.webhooks) == 1 {
+		deliverWebhook(ctx, batch.webhooks[0], batch.recordIDs[0])
+		return
+	}
+
+	if err := sendAggregatedNotification(ctx, batch.webhooks); err != nil {
+		slog.ErrorContext(ctx, "Error sending aggregated FCM notification",
+			append(webhookAttrs(batch.webhooks[0]), "count", len(batch.webhooks), "error", err)...)
+		for i, webhook := range batch.webhooks {
+			recordSendResult(ctx, batch.recordIDs[i], sendStatusFailed, err)
+			stats.Failed(webhook.Action)
+			writeDeadLetter(ctx, webhook, err)
+		}
+		return
+	}
+	for i, id := range batch.recordIDs {
+		recordSendResult(ctx, id, sendStatusSent, nil)
+		stats.Sent(batch.webhooks[i].Action)
+		markProcessed(ctx, batch.webhooks[i])
+	}
+}
+
+// close flushes every pending batch immediately and waits for the flushes to
+// finish.
+func (a *webhookAggregator) close() {
+	a.mu.Lock()
+	var pending []string
+	for key, batch := range a.batches {
+		if batch.timer.Stop() {
+			pending = append(pending, key)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, key := range pending {
+		a.flush(key)
+		a.flushes.Done()
+	}
+	a.flushes.Wait()
+}
+
+// sendAggregatedNotification sends one "N new orders" notification for a
+// batch of webhooks from the same event.
+func sendAggregatedNotification(ctx context.Context, webhooks []PretixWebhook) error {
+	title, body := aggregateText(webhooks)
+	slog.InfoContext(ctx, "Sending aggregated notification", append(webhookAttrs(webhooks[0]), "count", len(webhooks))...)
+	return sendBatchNotification(ctx, webhooks, title, body)
+}
+
+// sendBatchNotification sends one notification standing in for several
+// webhooks from the same event.
+func sendBatchNotification(ctx context.Context, webhooks []PretixWebhook, title, body string) error {
+	first := webhooks[0]
+	codes := make([]string, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		codes = append(codes, webhook.Code)
+	}
+
+	data := map[string]string{
+		"organizer":   first.Organizer,
+		"event":       first.Event,
+		"action":      first.Action,
+		"count":       fmt.Sprintf("%d", len(webhooks)),
+		"order_codes": strings.Join(codes, ","),
+		"title":       title,
+		"body":        body,
+	}
+
+	// Several orders have no single code to link to, so templates can check
+	// {{if .Code}} and link to the event instead.
+	nc := notificationContext{PretixWebhook: first, Type: webhookTypeOrder}
+	if len(webhooks) > 1 {
+		nc.Code = ""
+	}
+	link := deepLink(ctx, nc)
+	if link != "" {
+		data["deep_link"] = link
+	}
+
+	return notify(ctx, Event{
+		Webhook:        first,
+		Type:           webhookTypeOrder,
+		Title:          title,
+		Body:           body,
+		CollapseKey:    collapseKey(ctx, notificationContext{PretixWebhook: first}),
+		Batch:          webhooks,
+		Data:           data,
+		AnalyticsLabel: analyticsLabel(ctx, notificationContext{PretixWebhook: first}),
+		DeepLink:       link,
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fcmAlerter posts to a Slack or Discord webhook once FCM sends have failed
+// ALERT_FAILURE_THRESHOLD times in a row within ALERT_FAILURE_WINDOW, and
+// again when a send succeeds. Failures in between aren't re-alerted.
+type fcmAlerter struct {
+	webhookURL string
+	discord    bool
+	threshold  int
+	window     time.Duration
+	httpClient *http.Client
+	alerts     chan alertMessage
+
+	mu       sync.Mutex
+	failures []time.Time
+	alerting bool
+	since    time.Time
+}
+
+type alertMessage struct {
+	ctx  context.Context
+	text string
+}
+
+// alerter is set when ALERT_WEBHOOK_URL is configured.
+var alerter *fcmAlerter
+
+func newFCMAlerter(webhookURL string, threshold int, window, timeout time.Duration) *fcmAlerter {
+	a := &fcmAlerter{
+		webhookURL: webhookURL,
+		threshold:  max(threshold, 1),
+		window:     window,
+		httpClient: &http.Client{Timeout: timeout},
+		alerts:     make(chan alertMessage, 16),
+	}
+	go a.run()
+	if u, err := url.Parse(webhookURL); err == nil {
+		a.discord = u.Hostname() == "discord.com" || strings.HasSuffix(u.Hostname(), ".discord.com") ||
+			u.Hostname() == "discordapp.com"
+	}
+	return a
+}
+
+// recordFCMResult feeds the outcome of an FCM send to the alerter, if any.
+func recordFCMResult(ctx context.Context, err error) {
+	if alerter == nil {
+		return
+	}
+	if err != nil {
+		alerter.failure(ctx, err)
+	} else {
+		alerter.success(ctx)
+	}
+}
+
+func (a *fcmAlerter) failure(ctx context.Context, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.failures = append(a.failures, now)
+	for len(a.failures) > 0 && now.Sub(a.failures[0]) > a.window {
+		a.failures = a.failures[1:]
+	}
+	if a.alerting || len(a.failures) < a.threshold {
+		return
+	}
+
+	a.alerting, a.since = true, a.failures[0]
+	a.post(ctx, fmt.Sprintf("FCM send failing: %d errors in %s. Last error: %v", len(a.failures), a.window, err))
+}
+
+func (a *fcmAlerter) success(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failures = a.failures[:0]
+	if !a.alerting {
+		return
+	}
+
+	a.alerting = false
+	a.post(ctx, fmt.Sprintf("FCM sends recovered after %s", time.Since(a.since).Round(time.Second)))
+}
+
+// post queues text for the sender goroutine so FCM sends never wait on the
+// alert and a recovery is never posted before its failure alert.
+func (a *fcmAlerter) post(ctx context.Context, text string) {
+	ctx = context.WithoutCancel(ctx)
+	if config.DryRun {
+		slog.InfoContext(ctx, "Dry run, FCM alert not sent", "text", text)
+		return
+	}
+
+	select {
+	case a.alerts <- alertMessage{ctx: ctx, text: text}:
+	default:
+		slog.WarnContext(ctx, "Alert queue full, dropping FCM alert", "text", text)
+	}
+}
+
+func (a *fcmAlerter) run() {
+	for alert := range a.alerts {
+		if err := a.send(alert.ctx, alert.text); err != nil {
+			slog.ErrorContext(alert.ctx, "Error posting FCM alert", "error", err)
+			continue
+		}
+		slog.InfoContext(alert.ctx, "Posted FCM alert", "text", alert.text)
+	}
+}
+
+func (a *fcmAlerter) send(ctx context.Context, text string) error {
+	// Slack incoming webhooks take "text", Discord webhooks "content".
+	key := "text"
+	if a.discord {
+		key = "content"
+	}
+	payload, err := json.Marshal(map[string]string{key: text})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from alert webhook", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// maxFCMBatchSize is the most messages FCM accepts in one SendEach call.
+const maxFCMBatchSize = 500
+
+// fcmBatcher coalesces concurrent sends into SendEach calls of up to size
+// messages, flushing early after interval. Each caller still gets its own
+// result, so retries and dead-lettering stay per message.
+type fcmBatcher struct {
+	size     int
+	interval time.Duration
+
+	sends   chan batchedSend
+	done    chan struct{}
+	flushes sync.WaitGroup
+}
+
+type batchedSend struct {
+	client *messaging.Client
+	msg    *messaging.Message
+	result chan batchResult
+}
+
+type batchResult struct {
+	messageID string
+	err       error
+}
+
+// batcher is set when FCM_BATCH_INTERVAL is configured.
+var batcher *fcmBatcher
+
+func newFCMBatcher(size int, interval time.Duration) *fcmBatcher {
+	b := &fcmBatcher{
+		size:     min(max(size, 1), maxFCMBatchSize),
+		interval: interval,
+		sends:    make(chan batchedSend),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// send queues msg for the next batch and waits for its result.
+func (b *fcmBatcher) send(ctx context.Context, client *messaging.Client, msg *messaging.Message) (string, error) {
+	s := batchedSend{client: client, msg: msg, result: make(chan batchResult, 1)}
+	select {
+	case b.sends <- s:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	select {
+	case r := <-s.result:
+		return r.messageID, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// close flushes the pending batch and waits for in-flight batches. No sends
+// may be made after close.
+func (b *fcmBatcher) close() {
+	close(b.sends)
+	<-b.done
+	b.flushes.Wait()
+}
+
+func (b *fcmBatcher) run() {
+	defer close(b.done)
+
+	var pending []batchedSend
+	var timeout <-chan time.Time
+	flush := func() {
+		batch := pending
+		pending, timeout = nil, nil
+		b.flushes.Add(1)
+		go func() {
+			defer b.flushes.Done()
+			b.flush(batch)
+		}()
+	}
+
+	for {
+		select {
+		case s, ok := <-b.sends:
+			if !ok {
+				if len(pending) > 0 {
+					flush()
+				}
+				return
+			}
+			if len(pending) == 0 {
+				timeout = time.After(b.interval)
+			}
+			pending = append(pending, s)
+			if len(pending) >= b.size {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+// flush sends a batch with one SendEach call per FCM project.
+func (b *fcmBatcher) flush(batch []batchedSend) {
+	groups := make(map[*messaging.Client][]batchedSend)
+	for _, s := range batch {
+		groups[s.client] = append(groups[s.client], s)
+	}
+	for client, sends := range groups {
+		b.sendEach(client, sends)
+	}
+}
+
+func (b *fcmBatcher) sendEach(client *messaging.Client, sends []batchedSend) {
+	ctx := context.Background()
+	fail := func(err error) {
+		for _, s := range sends {
+			s.result <- batchResult{err: err}
+		}
+	}
+
+	if retryAfter := fcmRetryAfter(); retryAfter > 0 {
+		fail(&fcmQuotaError{retryAfter: retryAfter})
+		return
+	}
+
+	release, err := acquireSendSlot(ctx)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer release()
+
+	msgs := make([]*messaging.Message, len(sends))
+	for i, s := range sends {
+		msgs[i] = s.msg
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, config.FCMTimeout)
+	defer cancel()
+
+	response, err := client.SendEach(sendCtx, msgs)
+	trackFCMAuthFailure(ctx, err)
+	if isFCMQuotaError(err) {
+		fail(throttleFCM(ctx, err))
+		return
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	slog.DebugContext(ctx, "FCM batch sent", "messages", len(msgs),
+		"succeeded", response.SuccessCount, "failed", response.FailureCount)
+	for i, r := range response.Responses {
+		switch {
+		case r.Success:
+			sends[i].result <- batchResult{messageID: r.MessageID}
+		case isFCMQuotaError(r.Error):
+			sends[i].result <- batchResult{err: throttleFCM(ctx, r.Error)}
+		default:
+			sends[i].result <- batchResult{err: r.Error}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxConditionTopics is the FCM limit on topics referenced by one condition.
+const maxConditionTopics = 5
+
+var (
+	conditionTokenPattern = regexp.MustCompile(`^\s*(&&|\|\||!|\(|\)|'[^']*'|in\b|topics\b)`)
+	topicNamePattern      = regexp.MustCompile(`^[a-zA-Z0-9_.~%-]+$`)
+)
+
+// andTopics builds a condition matching devices subscribed to every topic,
+// e.g. "'devfest' in topics && 'vip' in topics".
+func andTopics(topics ...string) (string, error) {
+	return joinTopics("&&", topics)
+}
+
+// orTopics builds a condition matching devices subscribed to any of the
+// topics.
+func orTopics(topics ...string) (string, error) {
+	return joinTopics("||", topics)
+}
+
+func joinTopics(operator string, topics []string) (string, error) {
+	if len(topics) == 0 {
+		return "", fmt.Errorf("at least one topic is required")
+	}
+	if len(topics) > maxConditionTopics {
+		return "", fmt.Errorf("%d topics given, at most %d are allowed", len(topics), maxConditionTopics)
+	}
+
+	terms := make([]string, len(topics))
+	for i, topic := range topics {
+		if !topicNamePattern.MatchString(topic) {
+			return "", fmt.Errorf("invalid topic name %q", topic)
+		}
+		terms[i] = fmt.Sprintf("'%s' in topics", topic)
+	}
+	return strings.Join(terms, " "+operator+" "), nil
+}
+
+// validateTopicCondition checks that expr is a well-formed FCM topic
+// condition such as "'devfest' in topics && ('vip' in topics || 'speaker' in topics)".
+func validateTopicCondition(expr string) error {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return err
+	}
+
+	p := &conditionParser{tokens: tokens}
+	if err := p.parseOr(); err != nil {
+		return err
+	}
+	if p.pos < len(p.tokens) {
+		return fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if p.topics > maxConditionTopics {
+		return fmt.Errorf("condition references %d topics, at most %d are allowed", p.topics, maxConditionTopics)
+	}
+	return nil
+}
+
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	rest := expr
+	for strings.TrimSpace(rest) != "" {
+		match := conditionTokenPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected input at %q", strings.TrimSpace(rest))
+		}
+		tokens = append(tokens, match[1])
+		rest = rest[len(match[0]):]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("condition is empty")
+	}
+	return tokens, nil
+}
+
+// conditionParser is a recursive-descent parser for the FCM condition
+// grammar: or := and ("||" and)*, and := unary ("&&" unary)*,
+// unary := "!" unary | "(" or ")" | "'topic'" "in" "topics".
+type conditionParser struct {
+	tokens []string
+	pos    int
+	topics int
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) expect(token string) error {
+	if got := p.peek(); got != token {
+		if got == "" {
+			return fmt.Errorf("expected %q at end of condition", token)
+		}
+		return fmt.Errorf("expected %q, got %q", token, got)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *conditionParser) parseOr() error {
+	if err := p.parseAnd(); err != nil {
+		return err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		if err := p.parseAnd(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *conditionParser) parseAnd() error {
+	if err := p.parseUnary(); err != nil {
+		return err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		if err := p.parseUnary(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *conditionParser) parseUnary() error {
+	token := p.peek()
+	switch {
+	case token == "!":
+		p.pos++
+		return p.parseUnary()
+	case token == "(":
+		p.pos++
+		if err := p.parseOr(); err != nil {
+			return err
+		}
+		return p.expect(")")
+	case strings.HasPrefix(token, "'"):
+		topic := strings.Trim(token, "'")
+		if !topicNamePattern.MatchString(topic) {
+			return fmt.Errorf("invalid topic name %q", topic)
+		}
+		p.pos++
+		p.topics++
+		if err := p.expect("in"); err != nil {
+			return err
+		}
+		return p.expect("topics")
+	case token == "":
+		return fmt.Errorf("unexpected end of condition")
+	default:
+		return fmt.Errorf("unexpected %q", token)
+	}
+}
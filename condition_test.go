@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJoinTopics(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(...string) (string, error)
+		topics  []string
+		want    string
+		wantErr bool
+	}{
+		{"and single", andTopics, []string{"devfest"}, "'devfest' in topics", false},
+		{"and two", andTopics, []string{"devfest", "vip"}, "'devfest' in topics && 'vip' in topics", false},
+		{"or three", orTopics, []string{"staff", "volunteers", "finance"},
+			"'staff' in topics || 'volunteers' in topics || 'finance' in topics", false},
+		{"or five", orTopics, []string{"a", "b", "c", "d", "e"},
+			"'a' in topics || 'b' in topics || 'c' in topics || 'd' in topics || 'e' in topics", false},
+		{"allowed characters", andTopics, []string{"event_2024-x.y~%"}, "'event_2024-x.y~%' in topics", false},
+		{"no topics", orTopics, nil, "", true},
+		{"more than five", andTopics, []string{"a", "b", "c", "d", "e", "f"}, "", true},
+		{"space in name", orTopics, []string{"devfest", "vip guests"}, "", true},
+		{"quote in name", andTopics, []string{"it's"}, "", true},
+		{"empty name", orTopics, []string{""}, "", true},
+		{"slash in name", andTopics, []string{"/topics/devfest"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.build(tt.topics...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// Built conditions must pass the same check as FCM_TOPIC_CONDITION.
+			if err := validateTopicCondition(got); err != nil {
+				t.Errorf("validateTopicCondition(%q) = %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the typed form of the YAML config file and its APP_ENV
+// overlay. Each setting names the environment variable it stands for in its
+// env tag and is applied only when that variable isn't set, so the
+// environment always wins and loadConfig keeps a single parsing and
+// validation path. Settings without a field here can be given under env.
+type fileConfig struct {
+	AppEnv    *string  `yaml:"app_env" env:"APP_ENV"`
+	DryRun    *bool    `yaml:"dry_run" env:"DRY_RUN"`
+	Notifiers []string `yaml:"notifiers" env:"NOTIFIERS"`
+
+	Server struct {
+		Port               *string        `yaml:"port" env:"PORT"`
+		BasePath           *string        `yaml:"base_path" env:"BASE_PATH"`
+		MetricsPort        *string        `yaml:"metrics_port" env:"METRICS_PORT"`
+		AdminToken         *string        `yaml:"admin_token" env:"ADMIN_TOKEN"`
+		RequestTimeout     *time.Duration `yaml:"request_timeout" env:"REQUEST_TIMEOUT"`
+		ReadTimeout        *time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT"`
+		ReadHeaderTimeout  *time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+		WriteTimeout       *time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT"`
+		IdleTimeout        *time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT"`
+		ShutdownTimeout    *time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+		MaxBodyBytes       *int64         `yaml:"max_body_bytes" env:"MAX_BODY_BYTES"`
+		RateLimit          *float64       `yaml:"rate_limit" env:"RATE_LIMIT"`
+		RateLimitBurst     *int           `yaml:"rate_limit_burst" env:"RATE_LIMIT_BURST"`
+		TrustProxyHeaders  *bool          `yaml:"trust_proxy_headers" env:"TRUST_PROXY_HEADERS"`
+		TrustedProxyCount  *int           `yaml:"trusted_proxy_count" env:"TRUSTED_PROXY_COUNT"`
+		CORSAllowedOrigins []string       `yaml:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	} `yaml:"server"`
+
+	TLS struct {
+		CertFile     *string  `yaml:"cert_file" env:"TLS_CERT_FILE"`
+		KeyFile      *string  `yaml:"key_file" env:"TLS_KEY_FILE"`
+		MinVersion   *string  `yaml:"min_version" env:"TLS_MIN_VERSION"`
+		CipherSuites []string `yaml:"cipher_suites" env:"TLS_CIPHER_SUITES"`
+		ACMEHosts    []string `yaml:"acme_hosts" env:"ACME_HOSTS"`
+		ACMECacheDir *string  `yaml:"acme_cache_dir" env:"ACME_CACHE_DIR"`
+		ACMEEmail    *string  `yaml:"acme_email" env:"ACME_EMAIL"`
+		ACMEHTTPPort *string  `yaml:"acme_http_port" env:"ACME_HTTP_PORT"`
+	} `yaml:"tls"`
+
+	Webhook struct {
+		Secrets             []string          `yaml:"secrets" env:"WEBHOOK_SECRETS"`
+		PretixSecret        *string           `yaml:"pretix_secret" env:"PRETIX_WEBHOOK_SECRET"`
+		AllowedIPs          []string          `yaml:"allowed_ips" env:"WEBHOOK_ALLOWED_IPS"`
+		ResponseStatus      *int              `yaml:"response_status" env:"WEBHOOK_RESPONSE_STATUS"`
+		ResponseBody        *string           `yaml:"response_body" env:"WEBHOOK_RESPONSE_BODY"`
+		ResponseContentType *string           `yaml:"response_content_type" env:"WEBHOOK_RESPONSE_CONTENT_TYPE"`
+		FailureModes        map[string]string `yaml:"failure_modes" env:"WEBHOOK_ACTION_FAILURE_MODES"`
+		TestAction          *string           `yaml:"test_action" env:"PRETIX_TEST_ACTION"`
+		StrictJSON          *bool             `yaml:"strict_json" env:"STRICT_JSON"`
+		ValidateSchema      *bool             `yaml:"validate_schema" env:"VALIDATE_SCHEMA"`
+		ActionAllowlist     []string          `yaml:"action_allowlist" env:"FCM_ACTION_ALLOWLIST"`
+		ActionDenylist      []string          `yaml:"action_denylist" env:"FCM_ACTION_DENYLIST"`
+		QuietHours          *string           `yaml:"quiet_hours" env:"QUIET_HOURS"`
+		QuietHoursQueue     *bool             `yaml:"quiet_hours_queue" env:"QUIET_HOURS_QUEUE"`
+	} `yaml:"webhook"`
+
+	FCM struct {
+		ProjectID          *string           `yaml:"project_id" env:"FCM_PROJECT_ID"`
+		ProjectIDStrict    *bool             `yaml:"project_id_strict" env:"FCM_PROJECT_ID_STRICT"`
+		ServiceAccountPath *string           `yaml:"service_account_path" env:"FCM_SERVICE_ACCOUNT_PATH"`
+		ServiceAccountJSON *string           `yaml:"service_account_json" env:"FCM_SERVICE_ACCOUNT_JSON"`
+		Topic              *string           `yaml:"topic" env:"FCM_TOPIC"`
+		TopicCondition     *string           `yaml:"topic_condition" env:"FCM_TOPIC_CONDITION"`
+		ConditionTopics    []string          `yaml:"condition_topics" env:"FCM_CONDITION_TOPICS"`
+		ConditionOperator  *string           `yaml:"condition_operator" env:"FCM_CONDITION_OPERATOR"`
+		TopicMap           map[string]string `yaml:"topic_map" env:"FCM_TOPIC_MAP"`
+		ActionTopics       map[string]string `yaml:"action_topics" env:"FCM_ACTION_TOPICS"`
+		TypeTopics         map[string]string `yaml:"type_topics" env:"FCM_TYPE_TOPICS"`
+		CheckinTopic       *string           `yaml:"checkin_topic" env:"FCM_CHECKIN_TOPIC"`
+		RefundTopic        *string           `yaml:"refund_topic" env:"FCM_REFUND_TOPIC"`
+		DeviceTokens       []string          `yaml:"device_tokens" env:"FCM_DEVICE_TOKENS"`
+		DeviceTokensFile   *string           `yaml:"device_tokens_file" env:"FCM_DEVICE_TOKENS_FILE"`
+		TitleTemplate      *string           `yaml:"title_template" env:"FCM_TITLE_TEMPLATE"`
+		BodyTemplate       *string           `yaml:"body_template" env:"FCM_BODY_TEMPLATE"`
+		ActionTitles       map[string]string `yaml:"action_titles" env:"FCM_ACTION_TITLES"`
+		CollapseKey        *string           `yaml:"collapse_key" env:"FCM_COLLAPSE_KEY"`
+		DeepLink           *string           `yaml:"deep_link" env:"FCM_DEEP_LINK"`
+		ActionDeepLinks    map[string]string `yaml:"action_deep_links" env:"FCM_ACTION_DEEP_LINKS"`
+		DefaultLocale      *string           `yaml:"default_locale" env:"FCM_DEFAULT_LOCALE"`
+		Currency           *string           `yaml:"currency" env:"FCM_CURRENCY"`
+		ImageURL           *string           `yaml:"image_url" env:"FCM_IMAGE_URL"`
+		ImageMap           map[string]string `yaml:"image_map" env:"FCM_IMAGE_MAP"`
+		StaticData         map[string]string `yaml:"static_data" env:"FCM_STATIC_DATA"`
+		DataOnly           *bool             `yaml:"data_only" env:"FCM_DATA_ONLY"`
+		DataOnlyActions    []string          `yaml:"data_only_actions" env:"FCM_DATA_ONLY_ACTIONS"`
+		ExcludeEmail       *bool             `yaml:"exclude_email" env:"FCM_EXCLUDE_EMAIL"`
+		TTL                *time.Duration    `yaml:"ttl" env:"FCM_TTL"`
+		ActionTTLs         map[string]string `yaml:"action_ttls" env:"FCM_ACTION_TTLS"`
+		AggregationWindow  *time.Duration    `yaml:"aggregation_window" env:"FCM_AGGREGATION_WINDOW"`
+		AggregateActions   []string          `yaml:"aggregate_actions" env:"FCM_AGGREGATE_ACTIONS"`
+		Cooldown           *time.Duration    `yaml:"cooldown" env:"FCM_COOLDOWN"`
+		CooldownActions    []string          `yaml:"cooldown_actions" env:"FCM_COOLDOWN_ACTIONS"`
+		MaxRetries         *int              `yaml:"max_retries" env:"FCM_MAX_RETRIES"`
+		RetryBaseDelay     *time.Duration    `yaml:"retry_base_delay" env:"FCM_RETRY_BASE_DELAY"`
+		Timeout            *time.Duration    `yaml:"timeout" env:"FCM_TIMEOUT"`
+		InitTimeout        *time.Duration    `yaml:"init_timeout" env:"FCM_INIT_TIMEOUT"`
+		MaxConcurrentSends *int              `yaml:"max_concurrent_sends" env:"FCM_MAX_CONCURRENT_SENDS"`
+		QuotaBackoff       *time.Duration    `yaml:"quota_backoff" env:"FCM_QUOTA_BACKOFF"`
+		QuotaRequeue       *bool             `yaml:"quota_requeue" env:"FCM_QUOTA_REQUEUE"`
+		BatchSize          *int              `yaml:"batch_size" env:"FCM_BATCH_SIZE"`
+		BatchInterval      *time.Duration    `yaml:"batch_interval" env:"FCM_BATCH_INTERVAL"`
+		StartupSelfTest    *bool             `yaml:"startup_self_test" env:"STARTUP_SELFTEST"`
+
+		Android struct {
+			ChannelID           *string           `yaml:"channel_id" env:"FCM_ANDROID_CHANNEL_ID"`
+			Priority            *string           `yaml:"priority" env:"FCM_ANDROID_PRIORITY"`
+			HighPriorityActions []string          `yaml:"high_priority_actions" env:"FCM_ANDROID_HIGH_PRIORITY_ACTIONS"`
+			Sound               *string           `yaml:"sound" env:"FCM_ANDROID_SOUND"`
+			Icon                *string           `yaml:"icon" env:"FCM_ANDROID_ICON"`
+			Color               *string           `yaml:"color" env:"FCM_ANDROID_COLOR"`
+			ClickAction         *string           `yaml:"click_action" env:"FCM_ANDROID_CLICK_ACTION"`
+			ActionChannels      map[string]string `yaml:"action_channels" env:"FCM_ACTION_CHANNELS"`
+			ActionSounds        map[string]string `yaml:"action_sounds" env:"FCM_ACTION_SOUNDS"`
+		} `yaml:"android"`
+
+		APNS struct {
+			Enabled *bool   `yaml:"enabled" env:"FCM_APNS_ENABLED"`
+			Sound   *string `yaml:"sound" env:"FCM_APNS_SOUND"`
+			Badge   *int    `yaml:"badge" env:"FCM_APNS_BADGE"`
+		} `yaml:"apns"`
+	} `yaml:"fcm"`
+
+	Pretix struct {
+		APIURL     *string        `yaml:"api_url" env:"PRETIX_API_URL"`
+		APIToken   *string        `yaml:"api_token" env:"PRETIX_API_TOKEN"`
+		APITimeout *time.Duration `yaml:"api_timeout" env:"PRETIX_API_TIMEOUT"`
+	} `yaml:"pretix"`
+
+	Storage struct {
+		DBPath          *string        `yaml:"db_path" env:"DB_PATH"`
+		DedupTTL        *time.Duration `yaml:"dedup_ttl" env:"DEDUP_TTL"`
+		RedisURL        *string        `yaml:"redis_url" env:"REDIS_URL"`
+		DeadLetterPath  *string        `yaml:"deadletter_path" env:"DEADLETTER_PATH"`
+		AsyncProcessing *bool          `yaml:"async_processing" env:"ASYNC_PROCESSING"`
+		WorkerCount     *int           `yaml:"worker_count" env:"WORKER_COUNT"`
+		QueueSize       *int           `yaml:"queue_size" env:"QUEUE_SIZE"`
+	} `yaml:"storage"`
+
+	Log struct {
+		Level      *string `yaml:"level" env:"LOG_LEVEL"`
+		File       *string `yaml:"file" env:"LOG_FILE"`
+		MaxSizeMB  *int    `yaml:"max_size_mb" env:"LOG_MAX_SIZE_MB"`
+		MaxBackups *int    `yaml:"max_backups" env:"LOG_MAX_BACKUPS"`
+		MaxAgeDays *int    `yaml:"max_age_days" env:"LOG_MAX_AGE_DAYS"`
+		Compress   *bool   `yaml:"compress" env:"LOG_COMPRESS"`
+		Stderr     *bool   `yaml:"stderr" env:"LOG_STDERR"`
+		AccessLog  *bool   `yaml:"access_log" env:"ACCESS_LOG"`
+	} `yaml:"log"`
+
+	Slack struct {
+		WebhookURL *string        `yaml:"webhook_url" env:"SLACK_WEBHOOK_URL"`
+		Timeout    *time.Duration `yaml:"timeout" env:"SLACK_TIMEOUT"`
+	} `yaml:"slack"`
+
+	Email struct {
+		Host     *string        `yaml:"host" env:"SMTP_HOST"`
+		Port     *int           `yaml:"port" env:"SMTP_PORT"`
+		Username *string        `yaml:"username" env:"SMTP_USERNAME"`
+		Password *string        `yaml:"password" env:"SMTP_PASSWORD"`
+		From     *string        `yaml:"from" env:"SMTP_FROM"`
+		To       []string       `yaml:"to" env:"SMTP_TO"`
+		TLS      *string        `yaml:"tls" env:"SMTP_TLS"`
+		Timeout  *time.Duration `yaml:"timeout" env:"SMTP_TIMEOUT"`
+	} `yaml:"email"`
+
+	Forward struct {
+		URL            *string        `yaml:"url" env:"FORWARD_URL"`
+		Secret         *string        `yaml:"secret" env:"FORWARD_SECRET"`
+		Timeout        *time.Duration `yaml:"timeout" env:"FORWARD_TIMEOUT"`
+		MaxRetries     *int           `yaml:"max_retries" env:"FORWARD_MAX_RETRIES"`
+		RetryBaseDelay *time.Duration `yaml:"retry_base_delay" env:"FORWARD_RETRY_BASE_DELAY"`
+		Required       *bool          `yaml:"required" env:"FORWARD_REQUIRED"`
+	} `yaml:"forward"`
+
+	Alert struct {
+		WebhookURL       *string        `yaml:"webhook_url" env:"ALERT_WEBHOOK_URL"`
+		FailureThreshold *int           `yaml:"failure_threshold" env:"ALERT_FAILURE_THRESHOLD"`
+		FailureWindow    *time.Duration `yaml:"failure_window" env:"ALERT_FAILURE_WINDOW"`
+		Timeout          *time.Duration `yaml:"timeout" env:"ALERT_TIMEOUT"`
+	} `yaml:"alert"`
+
+	// Env sets any other environment variable by name, e.g. FCM_PROJECTS.
+	Env map[string]string `yaml:"env"`
+}
+
+// defaultConfigFile is read when CONFIG_FILE isn't set. Unlike an explicit
+// CONFIG_FILE it may be missing.
+const defaultConfigFile = "config.yaml"
+
+// loadConfigFiles reads the base config file and, when APP_ENV is set in the
+// environment or the base file, its overlay next to it: config.prod.yaml for
+// config.yaml and APP_ENV=prod. Overlay settings replace base ones, and the
+// merged settings fill in environment variables that aren't already set. It
+// returns the profile name.
+func loadConfigFiles() (string, error) {
+	path := os.Getenv("CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+
+	var fc fileConfig
+	if err := decodeConfigFile(path, &fc); err != nil {
+		if explicit || !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	appEnv := os.Getenv("APP_ENV")
+	if appEnv == "" && fc.AppEnv != nil {
+		appEnv = *fc.AppEnv
+	}
+	if appEnv != "" {
+		ext := filepath.Ext(path)
+		overlay := strings.TrimSuffix(path, ext) + "." + appEnv + ext
+		// A selected profile must exist so a typo doesn't silently run
+		// with the base settings.
+		if err := decodeConfigFile(overlay, &fc); err != nil {
+			return "", err
+		}
+	}
+
+	if err := fc.apply(); err != nil {
+		return "", err
+	}
+	return appEnv, nil
+}
+
+// decodeConfigFile decodes the YAML file at path into fc, keeping settings
+// the file doesn't mention. Unknown keys are rejected to catch typos.
+func decodeConfigFile(path string, fc *fileConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(fc); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return nil
+}
+
+// apply sets the environment variable behind every setting in fc that isn't
+// already set in the environment.
+func (fc *fileConfig) apply() error {
+	values := make(map[string]string)
+	if err := collectEnv(reflect.ValueOf(fc).Elem(), values); err != nil {
+		return err
+	}
+	for key, value := range fc.Env {
+		values[key] = value
+	}
+
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
+
+// collectEnv adds the environment variable form of each set field of the
+// struct v to values, descending into nested sections.
+func collectEnv(v reflect.Value, values map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			if value.Kind() == reflect.Struct {
+				if err := collectEnv(value, values); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if value.IsNil() {
+			continue
+		}
+
+		switch value.Kind() {
+		case reflect.Slice:
+			values[key] = strings.Join(value.Interface().([]string), ",")
+		case reflect.Map:
+			// Map settings are JSON objects in the environment.
+			data, err := json.Marshal(value.Interface())
+			if err != nil {
+				return fmt.Errorf("error encoding %s: %v", key, err)
+			}
+			values[key] = string(data)
+		case reflect.Pointer:
+			values[key] = formatEnvValue(value.Elem().Interface())
+		}
+	}
+	return nil
+}
+
+func formatEnvValue(value any) string {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// unsetEnv clears key for the rest of the test, restoring it afterwards.
+func unsetEnv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestLoadConfigFilesPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	base := writeConfigFile(t, dir, "config.yaml", `
+app_env: prod
+server:
+  port: "9000"
+  request_timeout: 4s
+fcm:
+  topic: base-topic
+  action_titles:
+    pretix.event.order.paid: Paid!
+  android:
+    priority: high
+`)
+	writeConfigFile(t, dir, "config.prod.yaml", `
+server:
+  port: "9443"
+fcm:
+  topic: prod-topic
+  condition_topics: [staff, volunteers]
+env:
+  FCM_PROJECTS: '{"other":{"project_id":"other"}}'
+`)
+
+	t.Setenv("CONFIG_FILE", base)
+	t.Setenv("FCM_TOPIC", "env-topic")
+	for _, key := range []string{"APP_ENV", "PORT", "REQUEST_TIMEOUT", "FCM_ACTION_TITLES", "FCM_ANDROID_PRIORITY", "FCM_CONDITION_TOPICS", "FCM_PROJECTS"} {
+		unsetEnv(t, key)
+	}
+
+	appEnv, err := loadConfigFiles()
+	if err != nil {
+		t.Fatalf("loadConfigFiles() error = %v", err)
+	}
+	if appEnv != "prod" {
+		t.Errorf("app env = %q, want prod", appEnv)
+	}
+
+	want := map[string]string{
+		"PORT":                 "9443",      // overlay over base
+		"REQUEST_TIMEOUT":      "4s",        // base only
+		"FCM_TOPIC":            "env-topic", // environment over both files
+		"FCM_ACTION_TITLES":    `{"pretix.event.order.paid":"Paid!"}`,
+		"FCM_ANDROID_PRIORITY": "high",
+		"FCM_CONDITION_TOPICS": "staff,volunteers",
+		"FCM_PROJECTS":         `{"other":{"project_id":"other"}}`,
+	}
+	for key, value := range want {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestLoadConfigFilesErrors(t *testing.T) {
+	dir := t.TempDir()
+	unsetEnv(t, "APP_ENV")
+
+	t.Run("missing default file", func(t *testing.T) {
+		unsetEnv(t, "CONFIG_FILE")
+		if _, err := loadConfigFiles(); err != nil {
+			t.Errorf("loadConfigFiles() error = %v, want nil without config.yaml", err)
+		}
+	})
+
+	t.Run("missing explicit file", func(t *testing.T) {
+		t.Setenv("CONFIG_FILE", filepath.Join(dir, "missing.yaml"))
+		if _, err := loadConfigFiles(); err == nil {
+			t.Error("loadConfigFiles() succeeded with a missing CONFIG_FILE")
+		}
+	})
+
+	t.Run("missing profile", func(t *testing.T) {
+		t.Setenv("CONFIG_FILE", writeConfigFile(t, dir, "profile.yaml", "server:\n  port: \"9000\"\n"))
+		t.Setenv("APP_ENV", "staging")
+		if _, err := loadConfigFiles(); err == nil {
+			t.Error("loadConfigFiles() succeeded without the selected profile")
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		t.Setenv("CONFIG_FILE", writeConfigFile(t, dir, "typo.yaml", "server:\n  prot: \"9000\"\n"))
+		if _, err := loadConfigFiles(); err == nil {
+			t.Error("loadConfigFiles() accepted an unknown key")
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		t.Setenv("CONFIG_FILE", writeConfigFile(t, dir, "type.yaml", "server:\n  request_timeout: soon\n"))
+		if _, err := loadConfigFiles(); err == nil {
+			t.Error("loadConfigFiles() accepted an invalid duration")
+		}
+	})
+}
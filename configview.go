@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+// redactedConfigFields hold credentials. Set values are shown as "***" so
+// the endpoint still tells whether they were configured.
+var redactedConfigFields = map[string]bool{
+	"FCMServiceAccountJSON": true,
+	"WebhookSecrets":        true,
+	"PretixWebhookSecret":   true,
+	"PretixAPIToken":        true,
+	"AdminToken":            true,
+	"DeviceTokens":          true,
+	"SlackWebhookURL":       true,
+	"AlertWebhookURL":       true,
+	"SMTPPassword":          true,
+	"ForwardSecret":         true,
+}
+
+// handleConfig returns the effective configuration with secrets redacted.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configView())
+}
+
+// configView renders config as JSON-friendly values keyed by field name.
+// Durations, log levels and templates are shown as they'd be written in the
+// environment.
+func configView() map[string]any {
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	view := make(map[string]any, t.NumField())
+	for i := range t.NumField() {
+		name := t.Field(i).Name
+		value := v.Field(i).Interface()
+		switch {
+		case redactedConfigFields[name]:
+			view[name] = redactSecret(value)
+		case name == "FCMProjects":
+			view[name] = redactProjects(config.FCMProjects)
+		case name == "RedisURL":
+			view[name] = redactURL(config.RedisURL)
+		default:
+			view[name] = configValue(value)
+		}
+	}
+	return view
+}
+
+func configValue(value any) any {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case slog.Level:
+		return v.String()
+	case *template.Template:
+		return templateSource(v)
+	case map[string]*template.Template:
+		out := make(map[string]string, len(v))
+		for key, tmpl := range v {
+			out[key] = templateSource(tmpl)
+		}
+		return out
+	case map[string]textTemplates:
+		out := make(map[string]map[string]string, len(v))
+		for key, texts := range v {
+			out[key] = map[string]string{"title": templateSource(texts.Title), "body": templateSource(texts.Body)}
+		}
+		return out
+	case map[string]time.Duration:
+		out := make(map[string]string, len(v))
+		for key, d := range v {
+			out[key] = d.String()
+		}
+		return out
+	case []*net.IPNet:
+		out := make([]string, len(v))
+		for i, ipNet := range v {
+			out[i] = ipNet.String()
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+func templateSource(tmpl *template.Template) string {
+	if tmpl == nil || tmpl.Tree == nil {
+		return ""
+	}
+	return tmpl.Root.String()
+}
+
+// redactSecret replaces every set value with "***", leaving empty values
+// empty.
+func redactSecret(value any) any {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return ""
+		}
+		return "***"
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = redactSecret(s).(string)
+		}
+		return out
+	default:
+		return "***"
+	}
+}
+
+func redactProjects(projects map[string]fcmProject) map[string]fcmProject {
+	out := make(map[string]fcmProject, len(projects))
+	for alias, project := range projects {
+		project.ServiceAccountJSON = redactSecret(project.ServiceAccountJSON).(string)
+		out[alias] = project
+	}
+	return out
+}
+
+// redactURL hides the password in a connection URL such as REDIS_URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactSecret(raw).(string)
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// cooldownState tracks an event's current cooldown window and the webhooks
+// suppressed during it.
+type cooldownState struct {
+	sentAt     time.Time
+	suppressed []PretixWebhook
+	recordIDs  []int64
+	timer      *time.Timer
+}
+
+// eventCooldown limits notifications to one per event per window. The first
+// webhook for an event is sent right away; matching webhooks arriving during
+// the following window are held and sent as a single "+12 more orders"
+// summary when it closes, which starts a new window.
+type eventCooldown struct {
+	window  time.Duration
+	actions []string
+
+	mu      sync.Mutex
+	events  map[string]*cooldownState
+	flushes sync.WaitGroup
+}
+
+// cooldown is set when FCM_COOLDOWN is configured.
+var cooldown *eventCooldown
+
+func newEventCooldown(window time.Duration, actions []string) *eventCooldown {
+	return &eventCooldown{
+		window:  window,
+		actions: actions,
+		events:  make(map[string]*cooldownState),
+	}
+}
+
+// suppress holds the webhook when its event is cooling down. It returns
+// false when the caller should deliver the webhook itself.
+func (c *eventCooldown) suppress(ctx context.Context, webhook PretixWebhook, recordID int64) bool {
+	matched := false
+	for _, pattern := range c.actions {
+		if matchAction(pattern, webhook.Action) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	key := webhook.Organizer + "/" + webhook.Event
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.events[key]
+	if !ok {
+		c.events[key] = &cooldownState{sentAt: time.Now(), timer: c.startTimer(key)}
+		return false
+	}
+
+	state.suppressed = append(state.suppressed, webhook)
+	state.recordIDs = append(state.recordIDs, recordID)
+	slog.DebugContext(ctx, "Webhook suppressed by event cooldown",
+		append(webhookAttrs(webhook), "pending", len(state.suppressed), "since", state.sentAt.Format(time.RFC3339))...)
+	return true
+}
+
+// startTimer schedules the end of key's window. c.mu must be held.
+func (c *eventCooldown) startTimer(key string) *time.Timer {
+	c.flushes.Add(1)
+	return time.AfterFunc(c.window, func() {
+		defer c.flushes.Done()
+		c.flush(key)
+	})
+}
+
+// flush ends key's window. Suppressed webhooks are sent as one summary and
+// a new window starts; an event with nothing suppressed leaves cooldown.
+func (c *eventCooldown) flush(key string) {
+	c.mu.Lock()
+	state, ok := c.events[key]
+	if !ok || len(state.suppressed) == 0 {
+		delete(c.events, key)
+		c.mu.Unlock()
+		return
+	}
+	webhooks, recordIDs := state.suppressed, state.recordIDs
+	c.events[key] = &cooldownState{sentAt: time.Now(), timer: c.startTimer(key)}
+	c.mu.Unlock()
+
+	c.send(webhooks, recordIDs)
+}
+
+func (c *eventCooldown) send(webhooks []PretixWebhook, recordIDs []int64) {
+	ctx := context.Background()
+	if len(webhooks) == 1 {
+		deliverWebhook(ctx, webhooks[0], recordIDs[0])
+		return
+	}
+
+	title, body := cooldownText(webhooks)
+	slog.InfoContext(ctx, "Sending cooldown summary", append(webhookAttrs(webhooks[0]), "count", len(webhooks))...)
+	if err := sendBatchNotification(ctx, webhooks, title, body); err != nil {
+		slog.ErrorContext(ctx, "Error sending cooldown summary",
+			append(webhookAttrs(webhooks[0]), "count", len(webhooks), "error", err)...)
+		for i, webhook := range webhooks {
+			recordSendResult(ctx, recordIDs[i], sendStatusFailed, err)
+			stats.Failed(webhook.Action)
+			writeDeadLetter(ctx, webhook, err)
+		}
+		return
+	}
+	for i, id := range recordIDs {
+		recordSendResult(ctx, id, sendStatusSent, nil)
+		stats.Sent(webhooks[i].Action)
+		markProcessed(ctx, webhooks[i])
+	}
+}
+
+// close sends every pending summary immediately and waits for in-flight
+// flushes to finish.
+func (c *eventCooldown) close() {
+	c.mu.Lock()
+	type pending struct {
+		webhooks  []PretixWebhook
+		recordIDs []int64
+	}
+	var summaries []pending
+	for key, state := range c.events {
+		if state.timer.Stop() {
+			c.flushes.Done()
+		}
+		if len(state.suppressed) > 0 {
+			summaries = append(summaries, pending{state.suppressed, state.recordIDs})
+		}
+		delete(c.events, key)
+	}
+	c.mu.Unlock()
+
+	for _, s := range summaries {
+		c.send(s.webhooks, s.recordIDs)
+	}
+	c.flushes.Wait()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var amountPattern = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+// currencySymbols maps ISO 4217 codes to the symbol shown before amounts.
+// Codes not listed here are shown as a prefix, e.g. "CHF 50.00".
+var currencySymbols = map[string]string{
+	"EUR": "€",
+	"USD": "$",
+	"GBP": "£",
+	"JPY": "¥",
+	"IDR": "Rp",
+	"INR": "₹",
+	"KRW": "₩",
+	"SGD": "S$",
+	"AUD": "A$",
+}
+
+// currencyDecimals lists currencies that don't use two minor units.
+var currencyDecimals = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"IDR": 0,
+}
+
+// parseTotal formats a Pretix decimal total like "1500.00" for display, e.g.
+// "€1,500.00". Without a currency code the grouped amount is returned alone.
+func parseTotal(s, currency string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("total is empty")
+	}
+	if !amountPattern.MatchString(s) {
+		return "", fmt.Errorf("invalid total %q", s)
+	}
+
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid total %q: %v", s, err)
+	}
+
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	decimals, ok := currencyDecimals[currency]
+	if !ok {
+		decimals = 2
+	}
+
+	formatted := groupThousands(strconv.FormatFloat(amount, 'f', decimals, 64))
+	switch symbol, ok := currencySymbols[currency]; {
+	case ok:
+		if strings.HasPrefix(formatted, "-") {
+			return "-" + symbol + formatted[1:], nil
+		}
+		return symbol + formatted, nil
+	case currency != "":
+		return currency + " " + formatted, nil
+	default:
+		return formatted, nil
+	}
+}
+
+// groupThousands inserts commas between groups of three integer digits.
+func groupThousands(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+
+	integer, fraction, hasFraction := strings.Cut(s, ".")
+	var sb strings.Builder
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(digit)
+	}
+	if hasFraction {
+		sb.WriteByte('.')
+		sb.WriteString(fraction)
+	}
+	return sign + sb.String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is a notification that could not be delivered, stored as one
+// JSON line in the dead-letter file so it can be replayed later.
+type deadLetter struct {
+	Webhook  PretixWebhook `json:"webhook"`
+	Error    string        `json:"error"`
+	FailedAt time.Time     `json:"failed_at"`
+}
+
+// deadLetterMu serializes access to the dead-letter file between writers
+// and /replay.
+var deadLetterMu sync.Mutex
+
+// writeDeadLetter appends a failed webhook to the dead-letter file. It is a
+// no-op when DEADLETTER_PATH is not configured.
+func writeDeadLetter(ctx context.Context, webhook PretixWebhook, sendErr error) {
+	if config.DeadLetterPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(deadLetter{
+		Webhook:  webhook,
+		Error:    sendErr.Error(),
+		FailedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding dead letter", append(webhookAttrs(webhook), "error", err)...)
+		return
+	}
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	f, err := os.OpenFile(config.DeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error opening dead-letter file", "path", config.DeadLetterPath, "error", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.ErrorContext(ctx, "Error writing dead letter", append(webhookAttrs(webhook), "error", err)...)
+		return
+	}
+	slog.WarnContext(ctx, "Webhook written to dead-letter file", webhookAttrs(webhook)...)
+}
+
+// replayDeadLetters re-sends every dead-lettered webhook and rewrites the
+// file with only the entries that failed again.
+func replayDeadLetters(ctx context.Context) (replayed, failed int, err error) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	data, err := os.ReadFile(config.DeadLetterPath)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading dead-letter file: %v", err)
+	}
+
+	var remaining bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), int(config.MaxBodyBytes)*2)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry deadLetter
+		if err := json.Unmarshal(line, &entry); err != nil {
+			slog.ErrorContext(ctx, "Skipping malformed dead letter", "error", err)
+			remaining.Write(line)
+			remaining.WriteByte('\n')
+			failed++
+			continue
+		}
+
+		if err := dispatch(ctx, entry.Webhook); err != nil {
+			slog.ErrorContext(ctx, "Replay failed", append(webhookAttrs(entry.Webhook), "error", err)...)
+			entry.Error = err.Error()
+			entry.FailedAt = time.Now().UTC()
+			updated, _ := json.Marshal(entry)
+			remaining.Write(updated)
+			remaining.WriteByte('\n')
+			failed++
+			continue
+		}
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, fmt.Errorf("error scanning dead-letter file: %v", err)
+	}
+
+	if err := os.WriteFile(config.DeadLetterPath, remaining.Bytes(), 0o600); err != nil {
+		return replayed, failed, fmt.Errorf("error rewriting dead-letter file: %v", err)
+	}
+	return replayed, failed, nil
+}
+
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if config.DeadLetterPath == "" {
+		writeJSONError(w, http.StatusNotFound, "Dead-letter file is not configured")
+		return
+	}
+
+	replayed, failed, err := replayDeadLetters(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error replaying dead letters", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error replaying dead letters")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Replayed dead letters", "replayed", replayed, "failed", failed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"replayed": replayed,
+		"failed":   failed,
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers which Pretix notifications were already delivered so
+// retried webhooks don't send the same push twice. Entries expire after the
+// store's TTL.
+type DedupStore interface {
+	// Seen reports whether the notification was processed within the TTL.
+	Seen(ctx context.Context, notificationID int64) (bool, error)
+	// MarkProcessed records a successfully delivered notification.
+	MarkProcessed(ctx context.Context, notificationID int64) error
+	Close() error
+}
+
+// dedupClaimer is implemented by dedup stores shared between instances. They
+// claim a notification atomically, so two instances receiving the same
+// webhook at once don't both send it.
+type dedupClaimer interface {
+	// Claim marks the notification as in progress, reporting false when it
+	// was already processed or claimed.
+	Claim(ctx context.Context, notificationID int64) (bool, error)
+	// Release drops a claim whose webhook Pretix was asked to retry.
+	Release(ctx context.Context, notificationID int64) error
+}
+
+// memoryDedupStore is a DedupStore that forgets everything on restart.
+type memoryDedupStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	processed map[int64]time.Time
+}
+
+func newMemoryDedupStore(ttl time.Duration) *memoryDedupStore {
+	return &memoryDedupStore{ttl: ttl, processed: make(map[int64]time.Time)}
+}
+
+func (s *memoryDedupStore) Seen(ctx context.Context, notificationID int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	processedAt, ok := s.processed[notificationID]
+	return ok && time.Since(processedAt) < s.ttl, nil
+}
+
+func (s *memoryDedupStore) MarkProcessed(ctx context.Context, notificationID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, processedAt := range s.processed {
+		if now.Sub(processedAt) >= s.ttl {
+			delete(s.processed, id)
+		}
+	}
+	s.processed[notificationID] = now
+	return nil
+}
+
+func (s *memoryDedupStore) Close() error {
+	return nil
+}
+
+// sqliteDedupStore is a DedupStore kept in the webhook SQLite database so it
+// survives restarts.
+type sqliteDedupStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+const createProcessedTable = `
+CREATE TABLE IF NOT EXISTS processed_notifications (
+	notification_id INTEGER PRIMARY KEY,
+	processed_at    TIMESTAMP NOT NULL
+)`
+
+// newSQLiteDedupStore shares db with the webhook store, which owns closing
+// it.
+func newSQLiteDedupStore(db *sql.DB, ttl time.Duration) (*sqliteDedupStore, error) {
+	if _, err := db.Exec(createProcessedTable); err != nil {
+		return nil, fmt.Errorf("error creating processed_notifications table: %v", err)
+	}
+	return &sqliteDedupStore{db: db, ttl: ttl}, nil
+}
+
+func (s *sqliteDedupStore) Seen(ctx context.Context, notificationID int64) (bool, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT 1 FROM processed_notifications WHERE notification_id = ? AND processed_at > ?`,
+		notificationID, time.Now().Add(-s.ttl).UTC()).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking processed notification: %v", err)
+	}
+	return true, nil
+}
+
+func (s *sqliteDedupStore) MarkProcessed(ctx context.Context, notificationID int64) error {
+	now := time.Now().UTC()
+	if _, err := s.db.ExecContext(ctx,
+		`DELETE FROM processed_notifications WHERE processed_at <= ?`, now.Add(-s.ttl)); err != nil {
+		return fmt.Errorf("error expiring processed notifications: %v", err)
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO processed_notifications (notification_id, processed_at) VALUES (?, ?)`,
+		notificationID, now); err != nil {
+		return fmt.Errorf("error marking notification processed: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteDedupStore) Close() error {
+	return nil
+}
+
+// isDuplicate reports whether a webhook's notification was already
+// delivered. Store errors are logged and treated as not seen, so a broken
+// store never drops notifications.
+func isDuplicate(ctx context.Context, webhook PretixWebhook) bool {
+	if dedup == nil || webhook.NotificationID == 0 {
+		return false
+	}
+
+	if claimer, ok := dedup.(dedupClaimer); ok {
+		claimed, err := claimer.Claim(ctx, int64(webhook.NotificationID))
+		if err != nil {
+			slog.ErrorContext(ctx, "Error checking dedup store", append(webhookAttrs(webhook), "error", err)...)
+			return false
+		}
+		return !claimed
+	}
+	return wasProcessed(ctx, webhook)
+}
+
+// wasProcessed reports whether a webhook's notification was already
+// delivered, without claiming it. Store errors are logged and treated as not
+// processed.
+func wasProcessed(ctx context.Context, webhook PretixWebhook) bool {
+	if dedup == nil || webhook.NotificationID == 0 {
+		return false
+	}
+
+	seen, err := dedup.Seen(ctx, int64(webhook.NotificationID))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking dedup store", append(webhookAttrs(webhook), "error", err)...)
+		return false
+	}
+	return seen
+}
+
+// releaseClaim drops the claim isDuplicate took on a webhook that Pretix
+// will retry.
+func releaseClaim(ctx context.Context, webhook PretixWebhook) {
+	claimer, ok := dedup.(dedupClaimer)
+	if !ok || webhook.NotificationID == 0 {
+		return
+	}
+
+	if err := claimer.Release(ctx, int64(webhook.NotificationID)); err != nil {
+		slog.ErrorContext(ctx, "Error releasing dedup claim", append(webhookAttrs(webhook), "error", err)...)
+	}
+}
+
+func markProcessed(ctx context.Context, webhook PretixWebhook) {
+	if dedup == nil || webhook.NotificationID == 0 {
+		return
+	}
+
+	if err := dedup.MarkProcessed(ctx, int64(webhook.NotificationID)); err != nil {
+		slog.ErrorContext(ctx, "Error updating dedup store", append(webhookAttrs(webhook), "error", err)...)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook types, derived from the action prefix.
+const (
+	webhookTypeOrder   = "order"
+	webhookTypeCheckin = "checkin"
+	webhookTypeEvent   = "event"
+	webhookTypeRefund  = "refund"
+)
+
+// webhookHandler sends the notification for one type of webhook.
+type webhookHandler func(ctx context.Context, webhook PretixWebhook) error
+
+// webhookHandlers routes each webhook type to its notification handler. New
+// types are added here.
+var webhookHandlers = map[string]webhookHandler{
+	webhookTypeOrder:   sendOrderNotification,
+	webhookTypeCheckin: sendCheckinNotification,
+	webhookTypeEvent:   sendEventNotification,
+	webhookTypeRefund:  sendRefundNotification,
+}
+
+// webhookType classifies an action: "pretix.event.order.refund.*" is a
+// refund, any other "pretix.event.order.*" an order, "pretix.event.checkin*"
+// a check-in and any other "pretix.event.*" action an event change. Actions
+// outside pretix.event are treated as orders.
+func webhookType(action string) string {
+	rest, ok := strings.CutPrefix(action, "pretix.event.")
+	if !ok {
+		return webhookTypeOrder
+	}
+
+	segment, _, _ := strings.Cut(rest, ".")
+	switch segment {
+	case "order":
+		if strings.HasPrefix(rest, "order.refund.") {
+			return webhookTypeRefund
+		}
+		return webhookTypeOrder
+	case "checkin":
+		return webhookTypeCheckin
+	default:
+		return webhookTypeEvent
+	}
+}
+
+// dispatch sends the notification for a webhook through the handler for its
+// type.
+func dispatch(ctx context.Context, webhook PretixWebhook) error {
+	handler, ok := webhookHandlers[webhookType(webhook.Action)]
+	if !ok {
+		handler = sendOrderNotification
+	}
+	return handler(ctx, webhook)
+}
+
+// sendCheckinNotification notifies about attendees scanning in, enriched
+// with the attendee, check-in list and scan time when the Pretix API is
+// configured.
+func sendCheckinNotification(ctx context.Context, webhook PretixWebhook) error {
+	nc := notificationContext{
+		PretixWebhook: webhook,
+		Type:          webhookTypeCheckin,
+		ActionTitle:   formatAction(webhook.Action),
+	}
+	data := baseNotificationData(webhook)
+
+	if pretix != nil && webhook.Code != "" {
+		details, err := pretix.fetchCheckinDetails(ctx, webhook.Organizer, webhook.Event, webhook.Code)
+		if err != nil {
+			slog.WarnContext(ctx, "Error fetching check-in details from Pretix API",
+				append(webhookAttrs(webhook), "error", err)...)
+		} else {
+			nc.AttendeeName = details.AttendeeName
+			nc.CheckinList = details.ListName
+			data["attendee_name"] = details.AttendeeName
+			data["checkin_list"] = details.ListName
+			if !details.ScannedAt.IsZero() {
+				nc.ScannedAt = details.ScannedAt
+				data["scanned_at"] = details.ScannedAt.Format(time.RFC3339)
+			}
+		}
+	}
+
+	return sendNotification(ctx, nc, data)
+}
+
+// sendRefundNotification notifies about refunds with their amount and
+// reason, taken from the webhook or else the Pretix API.
+func sendRefundNotification(ctx context.Context, webhook PretixWebhook) error {
+	currency := config.DefaultCurrency
+	if pretix != nil && webhook.Code != "" && (webhook.RefundAmount == "" || webhook.RefundID == 0) {
+		details, err := pretix.fetchRefundDetails(ctx, webhook.Organizer, webhook.Event, webhook.Code, webhook.RefundID)
+		if err != nil {
+			slog.WarnContext(ctx, "Error fetching refund details from Pretix API",
+				append(webhookAttrs(webhook), "error", err)...)
+		} else {
+			if webhook.RefundID == 0 {
+				webhook.RefundID = details.ID
+			}
+			if webhook.RefundAmount == "" {
+				webhook.RefundAmount = details.Amount
+			}
+			if webhook.RefundReason == "" {
+				webhook.RefundReason = details.Reason
+			}
+			if details.Currency != "" {
+				currency = details.Currency
+			}
+		}
+	}
+
+	var amountText string
+	if webhook.RefundAmount != "" {
+		var err error
+		if amountText, err = parseTotal(webhook.RefundAmount, currency); err != nil {
+			slog.WarnContext(ctx, "Error formatting refund amount", append(webhookAttrs(webhook), "error", err)...)
+		}
+	}
+
+	nc := notificationContext{
+		PretixWebhook: webhook,
+		Type:          webhookTypeRefund,
+		ActionTitle:   formatAction(webhook.Action),
+		RefundText:    amountText,
+	}
+
+	data := baseNotificationData(webhook)
+	if webhook.RefundID != 0 {
+		data["refund_id"] = strconv.Itoa(webhook.RefundID)
+	}
+	data["refund_amount"] = webhook.RefundAmount
+	data["refund_amount_formatted"] = amountText
+	data["refund_reason"] = webhook.RefundReason
+	data["currency"] = currency
+
+	return sendNotification(ctx, nc, data)
+}
+
+func sendEventNotification(ctx context.Context, webhook PretixWebhook) error {
+	nc := notificationContext{
+		PretixWebhook: webhook,
+		Type:          webhookTypeEvent,
+		ActionTitle:   formatAction(webhook.Action),
+	}
+	return sendNotification(ctx, nc, baseNotificationData(webhook))
+}
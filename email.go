@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP connection security modes for SMTP_TLS.
+const (
+	smtpTLSStartTLS = "starttls"
+	smtpTLSImplicit = "tls"
+	smtpTLSNone     = "none"
+)
+
+// emailNotifier sends each event as a plain-text email over SMTP.
+type emailNotifier struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+	tlsMode  string
+	timeout  time.Duration
+}
+
+func newEmailNotifier() *emailNotifier {
+	return &emailNotifier{
+		host:     config.SMTPHost,
+		port:     config.SMTPPort,
+		username: config.SMTPUsername,
+		password: config.SMTPPassword,
+		from:     config.SMTPFrom,
+		to:       config.SMTPTo,
+		tlsMode:  config.SMTPTLS,
+		timeout:  config.SMTPTimeout,
+	}
+}
+
+func (n *emailNotifier) Name() string {
+	return notifierEmail
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, event Event) error {
+	msg := n.message(event)
+
+	if config.DryRun {
+		slog.InfoContext(ctx, "Dry run, email not sent",
+			append(webhookAttrs(event.Webhook), "to", n.to, "subject", event.Title)...)
+		return nil
+	}
+
+	if err := n.send(ctx, msg); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Email sent successfully", append(webhookAttrs(event.Webhook), "recipients", len(n.to))...)
+	return nil
+}
+
+// send delivers msg to every recipient in one SMTP transaction.
+func (n *emailNotifier) send(ctx context.Context, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(n.host, strconv.Itoa(n.port))
+	tlsConfig := &tls.Config{ServerName: n.host}
+
+	var conn net.Conn
+	var err error
+	if n.tlsMode == smtpTLSImplicit {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error starting SMTP session: %w", err)
+	}
+	defer client.Close()
+
+	if n.tlsMode == smtpTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+
+	if n.username != "" {
+		// PlainAuth refuses to send credentials over an unencrypted
+		// connection to anything but localhost.
+		if err := client.Auth(smtp.PlainAuth("", n.username, n.password, n.host)); err != nil {
+			return fmt.Errorf("error authenticating with SMTP server: %w", err)
+		}
+	}
+
+	if err := client.Mail(n.from); err != nil {
+		return fmt.Errorf("error setting sender: %w", err)
+	}
+	for _, rcpt := range n.to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("error adding recipient %s: %w", maskEmail(rcpt), err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error starting message: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("error writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return client.Quit()
+}
+
+// emailDetails are the event data fields listed below the body, in order.
+var emailDetails = []struct{ key, label string }{
+	{"organizer", "Organizer"},
+	{"event", "Event"},
+	{"order_code", "Order"},
+	{"order_codes", "Orders"},
+	{"status", "Status"},
+	{"total_formatted", "Total"},
+	{"refund_amount_formatted", "Refund"},
+	{"refund_reason", "Refund reason"},
+	{"buyer_name", "Buyer"},
+	{"email", "Email"},
+	{"attendee_name", "Attendee"},
+	{"checkin_list", "Check-in list"},
+	{"scanned_at", "Scanned at"},
+}
+
+// message renders the event as a MIME message with the title as subject and
+// the body followed by the enriched order details.
+func (n *emailNotifier) message(event Event) []byte {
+	var text strings.Builder
+	text.WriteString(event.Body)
+	text.WriteString("\n\n")
+	for _, detail := range emailDetails {
+		if value := event.Data[detail.key]; value != "" {
+			fmt.Fprintf(&text, "%s: %s\n", detail.label, value)
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", event.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(text.String(), "\n", "\r\n")))
+	qp.Close()
+	return msg.Bytes()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookForwarder relays the original Pretix webhook body to a downstream
+// service such as an analytics pipeline. Unlike notifiers it sees every valid
+// webhook, including test pings, duplicates and filtered actions.
+type webhookForwarder struct {
+	url        string
+	secret     string
+	maxRetries int
+	baseDelay  time.Duration
+	httpClient *http.Client
+}
+
+// forwarder is set when FORWARD_URL is configured.
+var forwarder *webhookForwarder
+
+func newWebhookForwarder() *webhookForwarder {
+	return &webhookForwarder{
+		url:        config.ForwardURL,
+		secret:     config.ForwardSecret,
+		maxRetries: config.ForwardMaxRetries,
+		baseDelay:  config.ForwardRetryBaseDelay,
+		httpClient: &http.Client{Timeout: config.ForwardTimeout},
+	}
+}
+
+func (n *webhookForwarder) forward(ctx context.Context, webhook PretixWebhook) error {
+	// Replayed dead letters don't carry the raw body, so re-encode those.
+	body := webhook.RawBody
+	if len(body) == 0 {
+		var err error
+		if body, err = json.Marshal(webhook); err != nil {
+			return fmt.Errorf("error encoding webhook: %v", err)
+		}
+	}
+
+	if config.DryRun {
+		slog.InfoContext(ctx, "Dry run, webhook not forwarded", append(webhookAttrs(webhook), "url", n.url, "bytes", len(body))...)
+		return nil
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= n.maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(n.baseDelay, attempt)
+			slog.WarnContext(ctx, "Retrying webhook forward", append(webhookAttrs(webhook), "delay", delay.String(),
+				"attempt", attempt+1, "max_attempts", n.maxRetries+1, "error", lastErr)...)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		retryable, err := n.post(ctx, body)
+		if err == nil {
+			slog.InfoContext(ctx, "Webhook forwarded successfully", webhookAttrs(webhook)...)
+			return nil
+		}
+		lastErr = err
+
+		if !retryable || ctx.Err() != nil {
+			break
+		}
+	}
+	return lastErr
+}
+
+// post sends body once and reports whether a failure is worth retrying:
+// network errors, 429 and 5xx responses are.
+func (n *webhookForwarder) post(ctx context.Context, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %d from %s", resp.StatusCode, n.url)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
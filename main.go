@@ -1,20 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"cloud.google.com/go/compute/metadata"
 	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/errorutils"
 	"firebase.google.com/go/v4/messaging"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/option"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type PretixWebhook struct {
@@ -28,164 +59,2515 @@ type PretixWebhook struct {
 	Email  string `json:"email,omitempty"`  // Sometimes present
 	Total  string `json:"total,omitempty"`  // Sometimes present
 	Secret string `json:"secret,omitempty"` // Sometimes present
+	// Created is when the event happened in Pretix (RFC 3339), present on
+	// some payloads. Used to measure delivery lag.
+	Created string `json:"created,omitempty"`
+	// Refund fields, present on some refund webhooks. Missing values are
+	// loaded from the Pretix API when configured.
+	RefundID     int    `json:"refund_id,omitempty"`
+	RefundAmount string `json:"refund_amount,omitempty"`
+	RefundReason string `json:"refund_reason,omitempty"`
+
+	// RawBody is the original request body, kept for passthrough to clients.
+	RawBody []byte `json:"-"`
+}
+
+// CreatedAt parses Created, reporting false when it is missing or malformed.
+func (w PretixWebhook) CreatedAt() (time.Time, bool) {
+	if w.Created == "" {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(time.RFC3339Nano, w.Created)
+	return created, err == nil
+}
+
+// Validate checks that the fields every notification relies on are present.
+// Order actions must also carry an order code, since without it the
+// notification can't identify the order; other actions (like the Pretix test
+// ping) may omit it.
+func (w PretixWebhook) Validate() error {
+	var missing []string
+	if w.Organizer == "" {
+		missing = append(missing, "organizer")
+	}
+	if w.Event == "" {
+		missing = append(missing, "event")
+	}
+	if w.Action == "" {
+		missing = append(missing, "action")
+	}
+	if w.Code == "" && strings.HasPrefix(w.Action, "pretix.event.order.") {
+		missing = append(missing, "code")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+type Config struct {
+	AppEnv                   string
+	Port                     string
+	FCMServiceAccountPath    string
+	FCMServiceAccountJSON    string
+	FCMProjectID             string
+	FCMProjectIDStrict       bool
+	FCMProjects              map[string]fcmProject
+	FCMProjectMapping        map[string]string
+	FCMTopic                 string
+	FCMTopicCondition        string
+	FCMConditionTopics       []string
+	FCMConditionOperator     string
+	TopicMapping             map[string]string
+	TypeTopics               map[string]string
+	ActionTopics             map[string]string
+	WebhookSecrets           []string
+	WebhookResponseStatus    int
+	WebhookResponseBody      string
+	WebhookContentType       string
+	ActionFailureModes       map[string]string
+	PretixWebhookSecret      string
+	ShutdownTimeout          time.Duration
+	RequestTimeout           time.Duration
+	ReadTimeout              time.Duration
+	ReadHeaderTimeout        time.Duration
+	WriteTimeout             time.Duration
+	IdleTimeout              time.Duration
+	TLSCertFile              string
+	TLSKeyFile               string
+	TLSMinVersion            string
+	TLSCipherSuites          []string
+	ACMEHosts                []string
+	ACMECacheDir             string
+	ACMEEmail                string
+	ACMEHTTPPort             string
+	MaxBodyBytes             int64
+	FCMMaxRetries            int
+	FCMRetryBaseDelay        time.Duration
+	FCMTimeout               time.Duration
+	FCMAuthFailureThreshold  int
+	FCMInitTimeout           time.Duration
+	FCMQuotaBackoff          time.Duration
+	FCMQuotaRequeue          bool
+	FCMBatchSize             int
+	FCMBatchInterval         time.Duration
+	StartupSelfTest          bool
+	StartupSelfTestFatal     bool
+	MaxConcurrentSends       int
+	LogLevel                 slog.Level
+	LogFile                  string
+	LogMaxSizeMB             int
+	LogMaxBackups            int
+	LogMaxAgeDays            int
+	LogCompress              bool
+	LogStderr                bool
+	AccessLog                bool
+	MetricsPort              string
+	BasePath                 string
+	RateLimit                float64
+	RateLimitBurst           int
+	TrustProxyHeaders        bool
+	TrustedProxyCount        int
+	WebhookAllowedIPs        []*net.IPNet
+	CORSAllowedOrigins       []string
+	PretixAPIURL             string
+	PretixAPIToken           string
+	PretixAPITimeout         time.Duration
+	ActionAllowlist          []string
+	ActionDenylist           []string
+	AndroidChannelID         string
+	ActionChannels           map[string]string
+	AndroidPriority          string
+	AndroidSound             string
+	AndroidHighPriority      []string
+	AndroidIcon              string
+	AndroidColor             string
+	AndroidClickAction       string
+	VIPTotalThreshold        float64
+	VIPTopic                 string
+	VIPSound                 string
+	ActionSounds             map[string]string
+	DeepLink                 *template.Template
+	ActionDeepLinks          map[string]*template.Template
+	ImageURL                 string
+	ImageMapping             map[string]string
+	StaticData               map[string]string
+	StaticDataOverrides      bool
+	DataOnly                 bool
+	DataOnlyActions          []string
+	ExcludeEmail             bool
+	APNSEnabled              bool
+	APNSBadge                *int
+	APNSSound                string
+	CollapseKey              *template.Template
+	AnalyticsLabel           *template.Template
+	ActionAnalyticsLabels    map[string]string
+	MessageTTL               time.Duration
+	ActionTTLs               map[string]time.Duration
+	AggregationWindow        time.Duration
+	AggregateActions         []string
+	CooldownWindow           time.Duration
+	CooldownActions          []string
+	QuietHours               string
+	QuietHoursQueue          bool
+	DBPath                   string
+	DedupTTL                 time.Duration
+	RedisURL                 string
+	AsyncProcessing          bool
+	WorkerCount              int
+	QueueSize                int
+	DeadLetterPath           string
+	AdminToken               string
+	TitleTemplate            *template.Template
+	BodyTemplate             *template.Template
+	Locales                  map[string]textTemplates
+	ActionTemplates          map[string]textTemplates
+	DefaultLocale            string
+	LocaleMapping            map[string]string
+	DeviceTokens             []string
+	DeviceTokensFile         string
+	PretixTestAction         string
+	StrictJSON               bool
+	ValidateSchema           bool
+	FieldMap                 map[string]string
+	IncludeRawPayload        bool
+	RawPayloadMaxBytes       int
+	ActionTitles             map[string]string
+	ActionAcronyms           map[string]bool
+	ActionTitleIncludeObject bool
+	DefaultCurrency          string
+	Notifiers                []string
+	SlackWebhookURL          string
+	SlackTimeout             time.Duration
+	AlertWebhookURL          string
+	AlertFailureThreshold    int
+	AlertFailureWindow       time.Duration
+	AlertTimeout             time.Duration
+	SMTPHost                 string
+	SMTPPort                 int
+	SMTPUsername             string
+	SMTPPassword             string
+	SMTPFrom                 string
+	SMTPTo                   []string
+	SMTPTLS                  string
+	SMTPTimeout              time.Duration
+	ForwardURL               string
+	ForwardSecret            string
+	ForwardTimeout           time.Duration
+	ForwardMaxRetries        int
+	ForwardRetryBaseDelay    time.Duration
+	ForwardRequired          bool
+	DryRun                   bool
+}
+
+var (
+	config     Config
+	fcmClients map[string]*messaging.Client
+	pretix     *pretixClient
+	store      WebhookStore
+	dedup      DedupStore
+	queue      WebhookQueue
+	aggregator *webhookAggregator
+	limiter    *ipRateLimiter
+	tokenStore TokenStore
+)
+
+func loadConfig() {
+	godotenv.Load()
+	appEnv, err := loadConfigFiles()
+	if err != nil {
+		fatal("Error reading config file", "error", err)
+	}
+
+	config = Config{
+		AppEnv:                   appEnv,
+		Port:                     getEnvOrDefault("PORT", "8080"),
+		FCMServiceAccountPath:    os.Getenv("FCM_SERVICE_ACCOUNT_PATH"),
+		FCMServiceAccountJSON:    os.Getenv("FCM_SERVICE_ACCOUNT_JSON"),
+		FCMProjectID:             os.Getenv("FCM_PROJECT_ID"),
+		FCMProjectIDStrict:       getBoolOrDefault("FCM_PROJECT_ID_STRICT", false),
+		FCMTopic:                 getEnvOrDefault("FCM_TOPIC", "pretix-orders"),
+		FCMTopicCondition:        strings.TrimSpace(os.Getenv("FCM_TOPIC_CONDITION")),
+		FCMConditionTopics:       getListEnv("FCM_CONDITION_TOPICS"),
+		FCMConditionOperator:     strings.ToLower(getEnvOrDefault("FCM_CONDITION_OPERATOR", "or")),
+		WebhookSecrets:           getListEnv("WEBHOOK_SECRETS"),
+		WebhookResponseStatus:    getIntOrDefault("WEBHOOK_RESPONSE_STATUS", http.StatusOK),
+		WebhookResponseBody:      os.Getenv("WEBHOOK_RESPONSE_BODY"),
+		WebhookContentType:       getEnvOrDefault("WEBHOOK_RESPONSE_CONTENT_TYPE", "text/plain; charset=utf-8"),
+		PretixWebhookSecret:      os.Getenv("PRETIX_WEBHOOK_SECRET"),
+		ShutdownTimeout:          getDurationOrDefault("SHUTDOWN_TIMEOUT", 10*time.Second),
+		RequestTimeout:           getDurationOrDefault("REQUEST_TIMEOUT", 8*time.Second),
+		ReadTimeout:              getDurationOrDefault("READ_TIMEOUT", 5*time.Second),
+		ReadHeaderTimeout:        getDurationOrDefault("READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:             getDurationOrDefault("WRITE_TIMEOUT", 10*time.Second),
+		IdleTimeout:              getDurationOrDefault("IDLE_TIMEOUT", 60*time.Second),
+		TLSCertFile:              os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:               os.Getenv("TLS_KEY_FILE"),
+		TLSMinVersion:            getEnvOrDefault("TLS_MIN_VERSION", "1.2"),
+		TLSCipherSuites:          getListEnv("TLS_CIPHER_SUITES"),
+		ACMEHosts:                getListEnv("ACME_HOSTS"),
+		ACMECacheDir:             getEnvOrDefault("ACME_CACHE_DIR", "autocert-cache"),
+		ACMEEmail:                os.Getenv("ACME_EMAIL"),
+		ACMEHTTPPort:             getEnvOrDefault("ACME_HTTP_PORT", "80"),
+		MaxBodyBytes:             getInt64OrDefault("MAX_BODY_BYTES", 1<<20),
+		FCMMaxRetries:            getIntOrDefault("FCM_MAX_RETRIES", 2),
+		FCMRetryBaseDelay:        getDurationOrDefault("FCM_RETRY_BASE_DELAY", 200*time.Millisecond),
+		FCMTimeout:               getDurationOrDefault("FCM_TIMEOUT", 10*time.Second),
+		FCMAuthFailureThreshold:  getIntOrDefault("FCM_AUTH_FAILURE_THRESHOLD", 3),
+		FCMInitTimeout:           getDurationOrDefault("FCM_INIT_TIMEOUT", 30*time.Second),
+		FCMQuotaBackoff:          getDurationOrDefault("FCM_QUOTA_BACKOFF", time.Minute),
+		FCMQuotaRequeue:          getBoolOrDefault("FCM_QUOTA_REQUEUE", true),
+		FCMBatchSize:             getIntOrDefault("FCM_BATCH_SIZE", maxFCMBatchSize),
+		FCMBatchInterval:         getDurationOrDefault("FCM_BATCH_INTERVAL", 0),
+		StartupSelfTest:          getBoolOrDefault("STARTUP_SELFTEST", false),
+		StartupSelfTestFatal:     getBoolOrDefault("STARTUP_SELFTEST_FATAL", false),
+		MaxConcurrentSends:       getIntOrDefault("FCM_MAX_CONCURRENT_SENDS", 10),
+		MetricsPort:              os.Getenv("METRICS_PORT"),
+		LogFile:                  os.Getenv("LOG_FILE"),
+		LogMaxSizeMB:             getIntOrDefault("LOG_MAX_SIZE_MB", 100),
+		LogMaxBackups:            getIntOrDefault("LOG_MAX_BACKUPS", 5),
+		LogMaxAgeDays:            getIntOrDefault("LOG_MAX_AGE_DAYS", 28),
+		LogCompress:              getBoolOrDefault("LOG_COMPRESS", false),
+		LogStderr:                getBoolOrDefault("LOG_STDERR", isTerminal(os.Stderr)),
+		AccessLog:                getBoolOrDefault("ACCESS_LOG", false),
+		BasePath:                 normalizeBasePath(os.Getenv("BASE_PATH")),
+		RateLimit:                getFloatOrDefault("RATE_LIMIT", 0),
+		RateLimitBurst:           getIntOrDefault("RATE_LIMIT_BURST", 20),
+		TrustProxyHeaders:        getBoolOrDefault("TRUST_PROXY_HEADERS", false),
+		TrustedProxyCount:        getIntOrDefault("TRUSTED_PROXY_COUNT", 1),
+		CORSAllowedOrigins:       getListEnv("CORS_ALLOWED_ORIGINS"),
+		PretixAPIURL:             os.Getenv("PRETIX_API_URL"),
+		PretixAPIToken:           os.Getenv("PRETIX_API_TOKEN"),
+		PretixAPITimeout:         getDurationOrDefault("PRETIX_API_TIMEOUT", 5*time.Second),
+		ActionAllowlist:          getListEnv("FCM_ACTION_ALLOWLIST"),
+		ActionDenylist:           getListEnv("FCM_ACTION_DENYLIST"),
+		AndroidChannelID:         os.Getenv("FCM_ANDROID_CHANNEL_ID"),
+		AndroidPriority:          getEnvOrDefault("FCM_ANDROID_PRIORITY", "normal"),
+		AndroidSound:             os.Getenv("FCM_ANDROID_SOUND"),
+		AndroidHighPriority:      getListEnv("FCM_ANDROID_HIGH_PRIORITY_ACTIONS"),
+		VIPTotalThreshold:        getFloatOrDefault("FCM_VIP_TOTAL_THRESHOLD", 0),
+		VIPTopic:                 os.Getenv("FCM_VIP_TOPIC"),
+		VIPSound:                 os.Getenv("FCM_VIP_SOUND"),
+		AndroidIcon:              os.Getenv("FCM_ANDROID_ICON"),
+		AndroidColor:             os.Getenv("FCM_ANDROID_COLOR"),
+		AndroidClickAction:       os.Getenv("FCM_ANDROID_CLICK_ACTION"),
+		ImageURL:                 os.Getenv("FCM_IMAGE_URL"),
+		StaticDataOverrides:      getBoolOrDefault("FCM_STATIC_DATA_OVERRIDE", false),
+		DataOnly:                 getBoolOrDefault("FCM_DATA_ONLY", false),
+		DataOnlyActions:          getListEnv("FCM_DATA_ONLY_ACTIONS"),
+		ExcludeEmail:             getBoolOrDefault("FCM_EXCLUDE_EMAIL", false),
+		APNSEnabled:              getBoolOrDefault("FCM_APNS_ENABLED", false),
+		APNSSound:                getEnvOrDefault("FCM_APNS_SOUND", "default"),
+		AggregationWindow:        getDurationOrDefault("FCM_AGGREGATION_WINDOW", 0),
+		MessageTTL:               getDurationOrDefault("FCM_TTL", 4*time.Hour),
+		AggregateActions:         getListEnv("FCM_AGGREGATE_ACTIONS"),
+		CooldownWindow:           getDurationOrDefault("FCM_COOLDOWN", 0),
+		CooldownActions:          getListEnv("FCM_COOLDOWN_ACTIONS"),
+		QuietHours:               os.Getenv("QUIET_HOURS"),
+		QuietHoursQueue:          getBoolOrDefault("QUIET_HOURS_QUEUE", false),
+		DBPath:                   os.Getenv("DB_PATH"),
+		DedupTTL:                 getDurationOrDefault("DEDUP_TTL", 24*time.Hour),
+		RedisURL:                 os.Getenv("REDIS_URL"),
+		AsyncProcessing:          getBoolOrDefault("ASYNC_PROCESSING", false),
+		WorkerCount:              getIntOrDefault("WORKER_COUNT", 4),
+		QueueSize:                getIntOrDefault("QUEUE_SIZE", 100),
+		DeadLetterPath:           os.Getenv("DEADLETTER_PATH"),
+		AdminToken:               os.Getenv("ADMIN_TOKEN"),
+		DefaultLocale:            getEnvOrDefault("FCM_DEFAULT_LOCALE", "en"),
+		DeviceTokens:             getListEnv("FCM_DEVICE_TOKENS"),
+		DeviceTokensFile:         os.Getenv("FCM_DEVICE_TOKENS_FILE"),
+		PretixTestAction:         getEnvOrDefault("PRETIX_TEST_ACTION", "pretix.event.test"),
+		StrictJSON:               getBoolOrDefault("STRICT_JSON", false),
+		ValidateSchema:           getBoolOrDefault("VALIDATE_SCHEMA", false),
+		IncludeRawPayload:        getBoolOrDefault("FCM_INCLUDE_RAW_PAYLOAD", false),
+		RawPayloadMaxBytes:       getIntOrDefault("FCM_RAW_PAYLOAD_MAX_BYTES", 2048),
+		ActionAcronyms:           make(map[string]bool),
+		ActionTitleIncludeObject: getBoolOrDefault("FCM_ACTION_TITLE_INCLUDE_OBJECT", false),
+		DefaultCurrency:          strings.ToUpper(os.Getenv("FCM_CURRENCY")),
+		Notifiers:                getListEnv("NOTIFIERS"),
+		SlackWebhookURL:          os.Getenv("SLACK_WEBHOOK_URL"),
+		SlackTimeout:             getDurationOrDefault("SLACK_TIMEOUT", 5*time.Second),
+		AlertWebhookURL:          os.Getenv("ALERT_WEBHOOK_URL"),
+		AlertFailureThreshold:    getIntOrDefault("ALERT_FAILURE_THRESHOLD", 10),
+		AlertFailureWindow:       getDurationOrDefault("ALERT_FAILURE_WINDOW", 5*time.Minute),
+		AlertTimeout:             getDurationOrDefault("ALERT_TIMEOUT", 5*time.Second),
+		SMTPHost:                 os.Getenv("SMTP_HOST"),
+		SMTPPort:                 getIntOrDefault("SMTP_PORT", 587),
+		SMTPUsername:             os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:             os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:                 os.Getenv("SMTP_FROM"),
+		SMTPTo:                   getListEnv("SMTP_TO"),
+		SMTPTLS:                  strings.ToLower(getEnvOrDefault("SMTP_TLS", smtpTLSStartTLS)),
+		SMTPTimeout:              getDurationOrDefault("SMTP_TIMEOUT", 10*time.Second),
+		ForwardURL:               os.Getenv("FORWARD_URL"),
+		ForwardSecret:            os.Getenv("FORWARD_SECRET"),
+		ForwardTimeout:           getDurationOrDefault("FORWARD_TIMEOUT", 5*time.Second),
+		ForwardMaxRetries:        getIntOrDefault("FORWARD_MAX_RETRIES", 2),
+		ForwardRetryBaseDelay:    getDurationOrDefault("FORWARD_RETRY_BASE_DELAY", 500*time.Millisecond),
+		ForwardRequired:          getBoolOrDefault("FORWARD_REQUIRED", false),
+		DryRun:                   getBoolOrDefault("DRY_RUN", false),
+	}
+
+	acronyms := getListEnv("FCM_ACTION_ACRONYMS")
+	if os.Getenv("FCM_ACTION_ACRONYMS") == "" {
+		acronyms = []string{"API", "ID", "PDF", "SEPA", "URL", "VAT"}
+	}
+	for _, acronym := range acronyms {
+		config.ActionAcronyms[strings.ToUpper(acronym)] = true
+	}
+
+	if os.Getenv("FCM_APNS_BADGE") != "" {
+		badge := getIntOrDefault("FCM_APNS_BADGE", 0)
+		config.APNSBadge = &badge
+	}
+
+	if config.TitleTemplate, err = parseTemplate("title", os.Getenv("FCM_TITLE_TEMPLATE")); err != nil {
+		fatal("Invalid FCM_TITLE_TEMPLATE", "error", err)
+	}
+	if config.BodyTemplate, err = parseTemplate("body", os.Getenv("FCM_BODY_TEMPLATE")); err != nil {
+		fatal("Invalid FCM_BODY_TEMPLATE", "error", err)
+	}
+	if config.CollapseKey, err = parseTemplate("collapse_key", os.Getenv("FCM_COLLAPSE_KEY")); err != nil {
+		fatal("Invalid FCM_COLLAPSE_KEY", "error", err)
+	}
+	if config.AnalyticsLabel, err = parseTemplate("analytics_label", os.Getenv("FCM_ANALYTICS_LABEL")); err != nil {
+		fatal("Invalid FCM_ANALYTICS_LABEL", "error", err)
+	}
+	if raw := os.Getenv("FCM_ACTION_ANALYTICS_LABELS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ActionAnalyticsLabels); err != nil {
+			fatal("Invalid FCM_ACTION_ANALYTICS_LABELS", "error", err)
+		}
+		for action, label := range config.ActionAnalyticsLabels {
+			if !analyticsLabelPattern.MatchString(label) {
+				fatal("Invalid FCM_ACTION_ANALYTICS_LABELS label, expected 1-50 of [A-Za-z0-9-_.~%]", "action", action, "label", label)
+			}
+		}
+	}
+	if config.DeepLink, err = parseDeepLink("deep_link", os.Getenv("FCM_DEEP_LINK")); err != nil {
+		fatal("Invalid FCM_DEEP_LINK", "error", err)
+	}
+	if raw := os.Getenv("FCM_ACTION_DEEP_LINKS"); raw != "" {
+		var links map[string]string
+		if err := json.Unmarshal([]byte(raw), &links); err != nil {
+			fatal("Invalid FCM_ACTION_DEEP_LINKS", "error", err)
+		}
+		config.ActionDeepLinks = make(map[string]*template.Template, len(links))
+		for action, text := range links {
+			if config.ActionDeepLinks[action], err = parseDeepLink("deep_link."+action, text); err != nil {
+				fatal("Invalid FCM_ACTION_DEEP_LINKS template", "action", action, "error", err)
+			}
+		}
+	}
+	if len(config.Notifiers) == 0 {
+		config.Notifiers = []string{notifierFCM}
+	}
+	if len(config.AggregateActions) == 0 {
+		config.AggregateActions = []string{"pretix.event.order.placed"}
+	}
+	if len(config.CooldownActions) == 0 {
+		config.CooldownActions = []string{"pretix.event.order.placed"}
+	}
+	if config.Locales, err = parseTextTemplates(os.Getenv("FCM_LOCALES")); err != nil {
+		fatal("Invalid FCM_LOCALES", "error", err)
+	}
+	if config.ActionTemplates, err = parseTextTemplates(os.Getenv("FCM_ACTION_TEMPLATES")); err != nil {
+		fatal("Invalid FCM_ACTION_TEMPLATES", "error", err)
+	}
+	if raw := os.Getenv("FIELD_MAP"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.FieldMap); err != nil {
+			fatal("Invalid FIELD_MAP", "error", err)
+		}
+		fields := webhookFields()
+		for field := range config.FieldMap {
+			if !fields[field] {
+				fatal("FIELD_MAP key is not a webhook field", "field", field)
+			}
+		}
+	}
+	if raw := os.Getenv("FCM_STATIC_DATA"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.StaticData); err != nil {
+			fatal("Invalid FCM_STATIC_DATA", "error", err)
+		}
+		for key := range config.StaticData {
+			if key == "from" || key == "notification" || strings.HasPrefix(key, "google.") || strings.HasPrefix(key, "gcm.") {
+				fatal("FCM_STATIC_DATA uses a key reserved by FCM", "key", key)
+			}
+		}
+	}
+	if raw := os.Getenv("WEBHOOK_ACTION_FAILURE_MODES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ActionFailureModes); err != nil {
+			fatal("Invalid WEBHOOK_ACTION_FAILURE_MODES", "error", err)
+		}
+		for action, mode := range config.ActionFailureModes {
+			if mode != failureModeRetry && mode != failureModeDrop {
+				fatal("WEBHOOK_ACTION_FAILURE_MODES values must be retry or drop", "action", action, "value", mode)
+			}
+		}
+	}
+	if raw := os.Getenv("FCM_ACTION_TITLES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ActionTitles); err != nil {
+			fatal("Invalid FCM_ACTION_TITLES", "error", err)
+		}
+	}
+	if raw := os.Getenv("FCM_ACTION_CHANNELS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ActionChannels); err != nil {
+			fatal("Invalid FCM_ACTION_CHANNELS", "error", err)
+		}
+		for action, channel := range config.ActionChannels {
+			if strings.TrimSpace(channel) == "" {
+				fatal("Invalid FCM_ACTION_CHANNELS, channel must not be empty", "action", action)
+			}
+		}
+	}
+	if raw := os.Getenv("FCM_ACTION_SOUNDS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ActionSounds); err != nil {
+			fatal("Invalid FCM_ACTION_SOUNDS", "error", err)
+		}
+		for action, sound := range config.ActionSounds {
+			if strings.TrimSpace(sound) == "" {
+				fatal("Invalid FCM_ACTION_SOUNDS, sound must not be empty", "action", action)
+			}
+		}
+	}
+	if raw := os.Getenv("FCM_ACTION_TTLS"); raw != "" {
+		var ttls map[string]string
+		if err := json.Unmarshal([]byte(raw), &ttls); err != nil {
+			fatal("Invalid FCM_ACTION_TTLS", "error", err)
+		}
+		config.ActionTTLs = make(map[string]time.Duration, len(ttls))
+		for action, value := range ttls {
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl < 0 || ttl > maxMessageTTL {
+				fatal("Invalid FCM_ACTION_TTLS duration", "action", action, "value", value)
+			}
+			config.ActionTTLs[action] = ttl
+		}
+	}
+	if config.RequestTimeout > 0 && config.WriteTimeout > 0 && config.RequestTimeout >= config.WriteTimeout {
+		slog.Warn("REQUEST_TIMEOUT should be below WRITE_TIMEOUT, or the connection is closed before the 504 is sent",
+			"request_timeout", config.RequestTimeout.String(), "write_timeout", config.WriteTimeout.String())
+	}
+	if config.MessageTTL < 0 || config.MessageTTL > maxMessageTTL {
+		fatal("FCM_TTL must be between 0 and 28 days", "value", config.MessageTTL.String())
+	}
+	if raw := os.Getenv("FCM_LOCALE_MAP"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.LocaleMapping); err != nil {
+			fatal("Invalid FCM_LOCALE_MAP", "error", err)
+		}
+	}
+
+	if config.WebhookAllowedIPs, err = parseCIDRs(getListEnv("WEBHOOK_ALLOWED_IPS")); err != nil {
+		fatal("Invalid WEBHOOK_ALLOWED_IPS", "error", err)
+	}
+	if config.WebhookResponseStatus < 200 || config.WebhookResponseStatus > 299 {
+		fatal("WEBHOOK_RESPONSE_STATUS must be a 2xx status", "value", config.WebhookResponseStatus)
+	}
+	if config.TrustedProxyCount < 1 {
+		fatal("TRUSTED_PROXY_COUNT must be at least 1", "value", config.TrustedProxyCount)
+	}
+	if config.FCMMaxRetries < 0 {
+		fatal("FCM_MAX_RETRIES must not be negative", "value", config.FCMMaxRetries)
+	}
+	if config.FCMRetryBaseDelay < 0 {
+		fatal("FCM_RETRY_BASE_DELAY must not be negative", "value", config.FCMRetryBaseDelay.String())
+	}
+	if config.ForwardMaxRetries < 0 {
+		fatal("FORWARD_MAX_RETRIES must not be negative", "value", config.ForwardMaxRetries)
+	}
+	if config.ForwardRetryBaseDelay < 0 {
+		fatal("FORWARD_RETRY_BASE_DELAY must not be negative", "value", config.ForwardRetryBaseDelay.String())
+	}
+
+	if raw := os.Getenv("FCM_IMAGE_MAP"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ImageMapping); err != nil {
+			fatal("Invalid FCM_IMAGE_MAP", "error", err)
+		}
+	}
+	for key, image := range config.ImageMapping {
+		if err := validateImageURL(image); err != nil {
+			fatal("Invalid FCM_IMAGE_MAP", "key", key, "error", err)
+		}
+	}
+	if config.ImageURL != "" {
+		if err := validateImageURL(config.ImageURL); err != nil {
+			fatal("Invalid FCM_IMAGE_URL", "error", err)
+		}
+	}
+	if config.AndroidColor != "" && !androidColorPattern.MatchString(config.AndroidColor) {
+		fatal("FCM_ANDROID_COLOR must be in #RRGGBB format", "value", config.AndroidColor)
+	}
+
+	switch config.SMTPTLS {
+	case smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		fatal("SMTP_TLS must be \"starttls\", \"tls\" or \"none\"", "value", config.SMTPTLS)
+	}
+
+	if config.AndroidPriority != "normal" && config.AndroidPriority != "high" {
+		fatal("FCM_ANDROID_PRIORITY must be \"normal\" or \"high\"", "value", config.AndroidPriority)
+	}
+
+	if err := config.LogLevel.UnmarshalText([]byte(getEnvOrDefault("LOG_LEVEL", "info"))); err != nil {
+		fatal("Invalid LOG_LEVEL", "error", err)
+	}
+
+	config.FCMProjects = map[string]fcmProject{
+		defaultFCMProject: {
+			ProjectID:          config.FCMProjectID,
+			ServiceAccountPath: config.FCMServiceAccountPath,
+			ServiceAccountJSON: config.FCMServiceAccountJSON,
+		},
+	}
+	if raw := os.Getenv("FCM_PROJECTS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.FCMProjects); err != nil {
+			fatal("Invalid FCM_PROJECTS", "error", err)
+		}
+	}
+	if raw := os.Getenv("FCM_PROJECT_MAP"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.FCMProjectMapping); err != nil {
+			fatal("Invalid FCM_PROJECT_MAP", "error", err)
+		}
+	}
+	for key, alias := range config.FCMProjectMapping {
+		if _, ok := config.FCMProjects[alias]; !ok {
+			fatal("FCM_PROJECT_MAP references an unknown project", "key", key, "project", alias)
+		}
+	}
+	for alias, project := range config.FCMProjects {
+		if err := checkProjectID(project); err != nil {
+			if config.FCMProjectIDStrict {
+				fatal("FCM project ID doesn't match the service account", "project", alias, "error", err)
+			}
+			slog.Warn("FCM project ID doesn't match the service account, sends will likely fail", "project", alias, "error", err)
+		}
+	}
+
+	if raw := os.Getenv("FCM_TOPIC_MAP"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.TopicMapping); err != nil {
+			fatal("Invalid FCM_TOPIC_MAP", "error", err)
+		}
+	}
+	if raw := os.Getenv("FCM_ACTION_TOPICS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.ActionTopics); err != nil {
+			fatal("Invalid FCM_ACTION_TOPICS", "error", err)
+		}
+	}
+	if raw := os.Getenv("FCM_TYPE_TOPICS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.TypeTopics); err != nil {
+			fatal("Invalid FCM_TYPE_TOPICS", "error", err)
+		}
+	}
+	if topic := os.Getenv("FCM_CHECKIN_TOPIC"); topic != "" {
+		if config.TypeTopics == nil {
+			config.TypeTopics = make(map[string]string)
+		}
+		config.TypeTopics[webhookTypeCheckin] = topic
+	}
+	if topic := os.Getenv("FCM_REFUND_TOPIC"); topic != "" {
+		if config.TypeTopics == nil {
+			config.TypeTopics = make(map[string]string)
+		}
+		config.TypeTopics[webhookTypeRefund] = topic
+	}
+	if len(config.FCMConditionTopics) > 0 {
+		if config.FCMTopicCondition != "" {
+			fatal("FCM_CONDITION_TOPICS and FCM_TOPIC_CONDITION can't both be set")
+		}
+		var condition string
+		switch config.FCMConditionOperator {
+		case "and":
+			condition, err = andTopics(config.FCMConditionTopics...)
+		case "or":
+			condition, err = orTopics(config.FCMConditionTopics...)
+		default:
+			fatal(`Invalid FCM_CONDITION_OPERATOR, expected "and" or "or"`, "value", config.FCMConditionOperator)
+		}
+		if err != nil {
+			fatal("Invalid FCM_CONDITION_TOPICS", "error", err)
+		}
+		config.FCMTopicCondition = condition
+	}
+	if config.FCMTopicCondition != "" {
+		if err := validateTopicCondition(config.FCMTopicCondition); err != nil {
+			fatal("Invalid FCM_TOPIC_CONDITION", "error", err)
+		}
+	}
+
+	if config.FCMServiceAccountPath == "" && config.FCMServiceAccountJSON == "" && !config.DryRun {
+		slog.Info("No FCM service account configured, using Application Default Credentials")
+	}
+	// WEBHOOK_SECRET predates WEBHOOK_SECRETS and is accepted alongside it.
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		config.WebhookSecrets = append(config.WebhookSecrets, secret)
+	}
+	if len(config.WebhookSecrets) == 0 {
+		slog.Warn("WEBHOOK_SECRETS is not set, /webhook accepts unauthenticated requests")
+	}
+}
+
+// fatal logs msg at error level and exits the process.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getListEnv splits a comma-separated environment variable into its
+// non-empty, trimmed elements.
+func getListEnv(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// normalizeBasePath turns a BASE_PATH value like "pretix-webhook/" into
+// "/pretix-webhook". An empty or "/" value means no prefix.
+func normalizeBasePath(path string) string {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+func getBoolOrDefault(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fatal("Invalid boolean environment variable", "key", key, "error", err)
+	}
+	return b
+}
+
+func getIntOrDefault(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("Invalid integer environment variable", "key", key, "error", err)
+	}
+	return n
+}
+
+func getFloatOrDefault(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fatal("Invalid number environment variable", "key", key, "error", err)
+	}
+	return f
+}
+
+func getInt64OrDefault(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fatal("Invalid integer environment variable", "key", key, "error", err)
+	}
+	return n
+}
+
+func getDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("Invalid duration environment variable", "key", key, "error", err)
+	}
+	return d
+}
+
+// fcmReady is set once the FCM clients are initialized. Until then webhooks
+// are answered with 503 and /readyz reports not ready.
+var fcmReady atomic.Bool
+
+// Backoff between FCM initialization attempts.
+const (
+	fcmInitBaseDelay = time.Second
+	fcmInitMaxDelay  = 30 * time.Second
+)
+
+// initFCM creates the FCM clients, retrying with backoff for up to
+// FCM_INIT_TIMEOUT so a brief Firebase outage during a deploy doesn't stop
+// the service from starting.
+func initFCM() error {
+	if config.DryRun {
+		slog.Warn("DRY_RUN is enabled, notifications will be logged instead of sent")
+		fcmReady.Store(true)
+		return nil
+	}
+
+	deadline := time.Now().Add(config.FCMInitTimeout)
+	delay := fcmInitBaseDelay
+	for {
+		err := reloadFCMClients(context.Background())
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		slog.Warn("Error initializing FCM, retrying", "delay", delay.String(), "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, fcmInitMaxDelay)
+	}
+}
+
+// retryInitFCM keeps trying to create the FCM clients in the background
+// after initFCM gave up, and runs the startup self-test once they exist. An
+// admin credential reload in the meantime ends the retries too.
+func retryInitFCM() {
+	delay := fcmInitBaseDelay
+	for !fcmReady.Load() {
+		time.Sleep(delay)
+		if fcmReady.Load() {
+			break
+		}
+		if err := reloadFCMClients(context.Background()); err != nil {
+			slog.Warn("Error initializing FCM, retrying", "delay", delay.String(), "error", err)
+			delay = min(delay*2, fcmInitMaxDelay)
+			continue
+		}
+
+		slog.Info("FCM initialized, leaving degraded mode")
+		if config.StartupSelfTest {
+			if err := selfTestFCM(context.Background()); err != nil {
+				slog.Error("Startup self-test failed", "error", err)
+			}
+		}
+		return
+	}
+}
+
+// requireFCMReady answers 503 while the FCM clients aren't initialized.
+func requireFCMReady(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fcmReady.Load() {
+			writeFCMUnavailable(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeFCMUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(fcmInitMaxDelay.Seconds())))
+	writeJSONError(w, http.StatusServiceUnavailable, "FCM is not available, retry later")
+}
+
+// selfTestFCM validates every FCM project's credentials and the configured
+// topic with a dry-run send, which FCM checks but never delivers.
+func selfTestFCM(ctx context.Context) error {
+	if config.DryRun {
+		slog.Info("Skipping startup self-test in DRY_RUN mode")
+		return nil
+	}
+
+	msg := &messaging.Message{
+		Notification: &messaging.Notification{Title: "Startup self-test", Body: "Startup self-test"},
+	}
+	if config.FCMTopicCondition != "" {
+		msg.Condition = config.FCMTopicCondition
+	} else {
+		msg.Topic = config.FCMTopic
+	}
+
+	fcmClientsMu.RLock()
+	clients := fcmClients
+	fcmClientsMu.RUnlock()
+
+	var errs []error
+	for alias, client := range clients {
+		sendCtx, cancel := context.WithTimeout(ctx, config.FCMTimeout)
+		response, err := client.SendDryRun(sendCtx, msg)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("project %s: %w", alias, err))
+			continue
+		}
+		slog.Info("Startup self-test succeeded", "project", alias, "message_id", response)
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	fcmClientsMu    sync.RWMutex
+	fcmAuthFailures atomic.Int32
+	// fcmReloadMu serializes reloads; fcmReloading is set while one triggered
+	// by auth failures runs in the background.
+	fcmReloadMu  sync.Mutex
+	fcmReloading atomic.Bool
+)
+
+// reloadFCMClients creates a fresh messaging client for every configured
+// project, re-reading credential files, and swaps them in only when all of
+// them initialize.
+func reloadFCMClients(ctx context.Context) error {
+	if config.DryRun {
+		return nil
+	}
+	fcmReloadMu.Lock()
+	defer fcmReloadMu.Unlock()
+
+	clients := make(map[string]*messaging.Client, len(config.FCMProjects))
+	for alias, project := range config.FCMProjects {
+		client, err := newFCMClient(ctx, project)
+		if err != nil {
+			return fmt.Errorf("error initializing FCM project %s: %v", alias, err)
+		}
+		clients[alias] = client
+	}
+
+	fcmClientsMu.Lock()
+	fcmClients = clients
+	fcmClientsMu.Unlock()
+	fcmAuthFailures.Store(0)
+	fcmReady.Store(true)
+	return nil
+}
+
+// trackFCMAuthFailure counts consecutive authentication failures and reloads
+// the FCM clients once FCM_AUTH_FAILURE_THRESHOLD is reached, e.g. after
+// credentials were rotated. The reload runs in the background so the send
+// that tripped it isn't held up, and only one runs at a time.
+func trackFCMAuthFailure(ctx context.Context, err error) {
+	if err == nil {
+		fcmAuthFailures.Store(0)
+		return
+	}
+	if !errorutils.IsUnauthenticated(err) && !errorutils.IsPermissionDenied(err) {
+		return
+	}
+	if config.FCMAuthFailureThreshold <= 0 || int(fcmAuthFailures.Add(1)) < config.FCMAuthFailureThreshold {
+		return
+	}
+	if !fcmReloading.CompareAndSwap(false, true) {
+		return
+	}
+	// A failed reload is retried after another run of failures.
+	fcmAuthFailures.Store(0)
+
+	slog.WarnContext(ctx, "Repeated FCM authentication failures, reloading credentials", "error", err)
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer fcmReloading.Store(false)
+		if err := reloadFCMClients(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error reloading FCM credentials", "error", err)
+		}
+	}()
+}
+
+func handleReloadCredentials(w http.ResponseWriter, r *http.Request) {
+	if err := reloadFCMClients(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "Error reloading FCM credentials", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reload FCM credentials")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Reloaded FCM credentials", "projects", len(config.FCMProjects))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "reloaded",
+		"projects": len(config.FCMProjects),
+	})
+}
+
+// fcmProject holds the credentials for one Firebase project. Projects are
+// configured in FCM_PROJECTS under an alias; the FCM_PROJECT_ID and
+// FCM_SERVICE_ACCOUNT_* settings form the "default" project.
+type fcmProject struct {
+	ProjectID          string `json:"project_id"`
+	ServiceAccountPath string `json:"service_account_path"`
+	ServiceAccountJSON string `json:"service_account_json"`
+}
+
+const defaultFCMProject = "default"
+
+func newFCMClient(ctx context.Context, project fcmProject) (*messaging.Client, error) {
+	// Without an explicit key, fall back to Application Default Credentials
+	// (e.g. GKE Workload Identity or the Cloud Run service account).
+	var opts []option.ClientOption
+	switch {
+	case project.ServiceAccountPath != "":
+		opts = append(opts, option.WithCredentialsFile(project.ServiceAccountPath))
+	case project.ServiceAccountJSON != "":
+		opts = append(opts, option.WithCredentialsJSON([]byte(project.ServiceAccountJSON)))
+	}
+	projectID := project.ProjectID
+	if projectID == "" && len(opts) == 0 && metadata.OnGCE() {
+		if id, err := metadata.ProjectID(); err == nil {
+			slog.Info("Using project ID from metadata server", "project_id", id)
+			projectID = id
+		}
+	}
+
+	app, err := firebase.NewApp(ctx, &firebase.Config{
+		ProjectID: projectID,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing firebase app: %v", err)
+	}
+
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting messaging client: %v", err)
+	}
+	return client, nil
+}
+
+// checkProjectID compares a project's configured ID with the project_id in
+// its service account, catching credentials copied from the wrong project.
+// Projects without an explicit ID or service account aren't checked.
+func checkProjectID(project fcmProject) error {
+	if project.ProjectID == "" {
+		return nil
+	}
+
+	var credentials []byte
+	switch {
+	case project.ServiceAccountPath != "":
+		var err error
+		if credentials, err = os.ReadFile(project.ServiceAccountPath); err != nil {
+			// Left for the Firebase client to report.
+			return nil
+		}
+	case project.ServiceAccountJSON != "":
+		credentials = []byte(project.ServiceAccountJSON)
+	default:
+		return nil
+	}
+
+	var account struct {
+		ProjectID string `json:"project_id"`
+	}
+	if err := json.Unmarshal(credentials, &account); err != nil || account.ProjectID == "" {
+		return nil
+	}
+	if account.ProjectID != project.ProjectID {
+		return fmt.Errorf("project ID %q doesn't match project_id %q in the service account", project.ProjectID, account.ProjectID)
+	}
+	return nil
+}
+
+// resolveProject returns the FCM project alias for a webhook, looked up in
+// FCM_PROJECT_MAP by "organizer/event" and then "organizer".
+func resolveProject(webhook PretixWebhook) string {
+	for _, key := range []string{webhook.Organizer + "/" + webhook.Event, webhook.Organizer} {
+		if alias, ok := config.FCMProjectMapping[key]; ok {
+			return alias
+		}
+	}
+	return defaultFCMProject
+}
+
+// getFCMClient returns the messaging client for a project alias. It is nil
+// in dry-run mode.
+func getFCMClient(alias string) *messaging.Client {
+	fcmClientsMu.RLock()
+	defer fcmClientsMu.RUnlock()
+	return fcmClients[alias]
+}
+
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	receivedAt := time.Now()
+
+	// REQUEST_TIMEOUT bounds everything below, including Pretix enrichment
+	// and FCM retries; a webhook still being sent then gets a 504.
+	if config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.RequestTimeout)
+		defer cancel()
+		ctx = withStageTracking(ctx)
+		r = r.WithContext(ctx)
+	}
+
+	if !checkWebhookSecret(r) {
+		slog.WarnContext(ctx, "Rejected webhook with missing or invalid secret", "client_ip", clientIP(r))
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if notifierEnabled(notifierFCM) && !fcmReady.Load() {
+		slog.WarnContext(ctx, "FCM not initialized, rejecting webhook", "client_ip", clientIP(r))
+		writeFCMUnavailable(w)
+		return
+	}
+
+	// MAX_BODY_BYTES caps the decompressed size so a small gzip body can't
+	// expand without bound.
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			slog.WarnContext(ctx, "Rejected webhook with malformed gzip body", "client_ip", clientIP(r), "error", err)
+			writeJSONError(w, http.StatusBadRequest, "Malformed gzip body")
+			return
+		}
+		r.Body = gz
+	default:
+		writeJSONError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Encoding %q", encoding))
+		return
+	}
+
+	setStage(ctx, "read body")
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading request body", "error", err)
+		if isBodyTooLarge(err) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Error reading request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if config.PretixWebhookSecret != "" &&
+		!verifySignature(body, r.Header.Get("X-Pretix-Signature"), config.PretixWebhookSecret) {
+		slog.WarnContext(ctx, "Rejected webhook with invalid signature", "client_ip", clientIP(r))
+		writeJSONError(w, http.StatusUnauthorized, "Invalid signature")
+		return
+	}
+
+	if isJSONArray(body) {
+		handleWebhookBatch(w, r, body, receivedAt)
+		return
+	}
+	processWebhook(ctx, body, receivedAt, clientIP(r)).write(w)
+}
+
+type stageKey struct{}
+
+// processingStage names the step of webhook processing in progress, so a
+// REQUEST_TIMEOUT can be traced to the slow step.
+type processingStage struct {
+	name atomic.Value
+}
+
+// withStageTracking logs the stage in progress if ctx's deadline passes.
+func withStageTracking(ctx context.Context) context.Context {
+	stage := &processingStage{}
+	stage.name.Store("start")
+	ctx = context.WithValue(ctx, stageKey{}, stage)
+	context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			slog.WarnContext(ctx, "Webhook processing deadline exceeded",
+				"stage", stage.name.Load(), "timeout", config.RequestTimeout.String())
+		}
+	})
+	return ctx
+}
+
+// setStage records that processing under ctx has reached stage. It is a
+// no-op without stage tracking, e.g. for queued or aggregated webhooks.
+func setStage(ctx context.Context, stage string) {
+	if s, ok := ctx.Value(stageKey{}).(*processingStage); ok {
+		s.name.Store(stage)
+	}
+}
+
+// webhookResult is the response to one webhook. Successful results carry a
+// 2xx status and no error.
+type webhookResult struct {
+	status     int
+	err        string
+	retryAfter time.Duration
+	duplicate  bool
+	// fields lists schema violations behind a 422.
+	fields []string
+
+	notificationID int
+}
+
+func (res webhookResult) write(w http.ResponseWriter) {
+	switch {
+	case res.err == "":
+		if res.duplicate {
+			w.Header().Set("X-Duplicate", "true")
+		}
+		writeWebhookSuccess(w, res.status)
+	case res.retryAfter > 0:
+		writeThrottled(w, res.retryAfter)
+	case len(res.fields) > 0:
+		writeJSONErrorFields(w, res.status, res.err, res.fields)
+	default:
+		writeJSONError(w, res.status, res.err)
+	}
+}
+
+// processWebhook parses, records and delivers (or queues) one webhook body.
+func processWebhook(ctx context.Context, body []byte, receivedAt time.Time, clientIP string) (res webhookResult) {
+	ctx, span := tracer.Start(ctx, "process webhook")
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", res.status))
+		if res.err != "" {
+			span.SetStatus(codes.Error, res.err)
+		}
+		span.End()
+	}()
+
+	setStage(ctx, "parse")
+	webhook, err := parseWebhook(ctx, body)
+	if schemaErr := (*schemaError)(nil); errors.As(err, &schemaErr) {
+		slog.WarnContext(ctx, "Webhook payload failed schema validation", "fields", schemaErr.fields)
+		return webhookResult{status: http.StatusUnprocessableEntity, err: "Payload does not match schema", fields: schemaErr.fields}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error parsing webhook payload", "error", err)
+		return webhookResult{status: http.StatusBadRequest, err: "Error parsing payload"}
+	}
+	span.SetAttributes(webhookSpanAttrs(webhook)...)
+	ok := func(status int) webhookResult {
+		return webhookResult{status: status, notificationID: webhook.NotificationID}
+	}
+	fail := func(status int, msg string) webhookResult {
+		return webhookResult{status: status, err: msg, notificationID: webhook.NotificationID}
+	}
+	throttled := func(retryAfter time.Duration) webhookResult {
+		res := fail(http.StatusTooManyRequests, "FCM quota exceeded, retry later")
+		res.retryAfter = retryAfter
+		return res
+	}
+
+	if err := webhook.Validate(); err != nil {
+		slog.WarnContext(ctx, "Invalid webhook payload", append(webhookAttrs(webhook), "error", err)...)
+		return fail(http.StatusBadRequest, fmt.Sprintf("Invalid payload: %v", err))
+	}
+
+	// Forwarding comes before any filtering so the sink sees every webhook
+	// Pretix sent.
+	if forwarder != nil {
+		setStage(ctx, "forward")
+		if err := forwarder.forward(ctx, webhook); err != nil {
+			slog.ErrorContext(ctx, "Error forwarding webhook", append(webhookAttrs(webhook), "error", err)...)
+			if config.ForwardRequired {
+				return fail(http.StatusServiceUnavailable, "Error forwarding webhook, retry later")
+			}
+		}
+	}
+
+	if isTestPing(webhook) {
+		slog.InfoContext(ctx, "Received Pretix test webhook, not sending notification", webhookAttrs(webhook)...)
+		return ok(config.WebhookResponseStatus)
+	}
+
+	slog.InfoContext(ctx, "Received webhook", append(webhookAttrs(webhook), "client_ip", clientIP)...)
+	webhooksReceived.WithLabelValues(webhook.Action).Inc()
+	stats.Received(webhook.Action)
+
+	setStage(ctx, "persist")
+	recordID := persistWebhook(ctx, webhook, body, receivedAt)
+
+	setStage(ctx, "dedup")
+	if isDuplicate(ctx, webhook) {
+		slog.InfoContext(ctx, "Skipping already processed webhook", webhookAttrs(webhook)...)
+		recordSendResult(ctx, recordID, sendStatusDuplicate, nil)
+		duplicateWebhooks.WithLabelValues(webhook.Action).Inc()
+		stats.Duplicate(webhook.Action)
+		// Still 200 so Pretix stops retrying.
+		res := ok(config.WebhookResponseStatus)
+		res.duplicate = true
+		return res
+	}
+	defer func() {
+		if res.err != "" {
+			releaseClaim(ctx, webhook)
+		}
+	}()
+
+	if !actionAllowed(webhook.Action) {
+		slog.InfoContext(ctx, "Skipping webhook for filtered action", webhookAttrs(webhook)...)
+		recordSendResult(ctx, recordID, sendStatusSkipped, nil)
+		return ok(config.WebhookResponseStatus)
+	}
+
+	if quiet != nil && quiet.suppress(ctx, webhook, recordID) {
+		return ok(config.WebhookResponseStatus)
+	}
+
+	if aggregator != nil && aggregator.add(ctx, webhook, recordID) {
+		return ok(http.StatusAccepted)
+	}
+
+	if cooldown != nil && cooldown.suppress(ctx, webhook, recordID) {
+		return ok(http.StatusAccepted)
+	}
+
+	if queue != nil {
+		if !queue.Enqueue(ctx, webhookJob{webhook: webhook, recordID: recordID, requestID: requestIDFrom(ctx), trace: injectTrace(ctx)}) {
+			slog.WarnContext(ctx, "Webhook queue full, rejecting webhook", webhookAttrs(webhook)...)
+			return fail(http.StatusServiceUnavailable, "Queue full, retry later")
+		}
+		return ok(http.StatusAccepted)
+	}
+
+	// Without a queue to hold webhooks, push back on Pretix while FCM is
+	// throttled instead of failing them.
+	if retryAfter := fcmRetryAfter(); retryAfter > 0 && notifierEnabled(notifierFCM) {
+		slog.WarnContext(ctx, "FCM quota exceeded, rejecting webhook", webhookAttrs(webhook)...)
+		recordSendResult(ctx, recordID, sendStatusFailed, &fcmQuotaError{retryAfter: retryAfter})
+		return throttled(retryAfter)
+	}
+
+	if err := sendWebhook(ctx, webhook, recordID); err != nil {
+		// Pretix retries a throttled webhook, so it isn't dead-lettered.
+		if quotaErr, ok := asFCMQuotaError(err); ok {
+			return throttled(quotaErr.retryAfter)
+		}
+		// Failures answered with an error are retried by Pretix, so only
+		// dropped ones are dead-lettered; replaying the others as well would
+		// send them twice.
+		switch mode, _ := lookupAction(config.ActionFailureModes, webhook.Action); mode {
+		case failureModeDrop:
+			slog.WarnContext(ctx, "Dropping failed webhook instead of asking Pretix to retry", webhookAttrs(webhook)...)
+			writeDeadLetter(ctx, webhook, err)
+			return ok(config.WebhookResponseStatus)
+		case failureModeRetry:
+			return fail(http.StatusServiceUnavailable, "Error processing webhook, retry later")
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fail(http.StatusGatewayTimeout, "Timed out sending notification")
+		}
+		return fail(http.StatusInternalServerError, "Error processing webhook")
+	}
+
+	return ok(config.WebhookResponseStatus)
+}
+
+// isJSONArray reports whether body's first non-whitespace byte opens an array.
+func isJSONArray(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// maxBatchWebhooks caps the webhooks per batch, which are processed one after
+// another within the request.
+const maxBatchWebhooks = 100
+
+// handleWebhookBatch processes each webhook in a JSON array, as some proxies
+// deliver them. It answers with the success response when every webhook
+// succeeded, with 429 or 503 when any should be retried, and otherwise with
+// 207 and a result per webhook.
+func handleWebhookBatch(w http.ResponseWriter, r *http.Request, body []byte, receivedAt time.Time) {
+	ctx := r.Context()
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil {
+		slog.ErrorContext(ctx, "Error parsing webhook batch", "error", err)
+		writeJSONError(w, http.StatusBadRequest, "Error parsing payload")
+		return
+	}
+	if len(elements) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Empty webhook batch")
+		return
+	}
+	if len(elements) > maxBatchWebhooks {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d webhooks are allowed per batch", maxBatchWebhooks))
+		return
+	}
+
+	slog.InfoContext(ctx, "Received webhook batch", "webhooks", len(elements), "client_ip", clientIP(r))
+	results := make([]webhookResult, len(elements))
+	failed := 0
+	retry := false
+	var retryAfter time.Duration
+	for i, element := range elements {
+		results[i] = processWebhook(ctx, element, receivedAt, clientIP(r))
+		if results[i].err != "" {
+			failed++
+		}
+		retry = retry || results[i].status == http.StatusTooManyRequests || results[i].status >= 500
+		retryAfter = max(retryAfter, results[i].retryAfter)
+	}
+
+	if failed == 0 {
+		writeWebhookSuccess(w, config.WebhookResponseStatus)
+		return
+	}
+
+	type batchItem struct {
+		Index          int      `json:"index"`
+		NotificationID int      `json:"notification_id,omitempty"`
+		Status         int      `json:"status"`
+		Error          string   `json:"error,omitempty"`
+		Fields         []string `json:"fields,omitempty"`
+	}
+	items := make([]batchItem, len(results))
+	for i, res := range results {
+		items[i] = batchItem{Index: i, NotificationID: res.notificationID, Status: res.status, Error: res.err, Fields: res.fields}
+	}
+
+	// Pretix only retries the whole batch, so any webhook that should be
+	// retried decides the status. Webhooks that went through are then
+	// skipped as duplicates.
+	status := http.StatusMultiStatus
+	switch {
+	case retryAfter > 0:
+		status = http.StatusTooManyRequests
+		setRetryAfter(w, retryAfter)
+	case retry:
+		status = http.StatusServiceUnavailable
+	}
+
+	slog.WarnContext(ctx, "Some webhooks in batch failed", "webhooks", len(elements), "failed", failed, "status", status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"succeeded": len(elements) - failed,
+		"failed":    failed,
+		"results":   items,
+	})
+}
+
+// Per-action responses to failed webhooks, set in WEBHOOK_ACTION_FAILURE_MODES.
+// Actions without a mode get a 500, which Pretix also retries.
+const (
+	failureModeRetry = "retry" // 503 so Pretix retries
+	failureModeDrop  = "drop"  // success so Pretix doesn't retry; dead-lettered
+)
+
+// writeWebhookSuccess answers a webhook Pretix should consider delivered with
+// the configured body, which is empty by default. Queued and aggregated
+// webhooks are answered with 202 instead of the configured status.
+func writeWebhookSuccess(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", config.WebhookContentType)
+	w.WriteHeader(status)
+	w.Write([]byte(config.WebhookResponseBody))
+}
+
+// deliverWebhook sends the notification for a webhook delivered in the
+// background, where Pretix can no longer retry it. Sends failing on the FCM
+// quota are requeued when possible; other failures are dead-lettered for
+// later replay.
+func deliverWebhook(ctx context.Context, webhook PretixWebhook, recordID int64) error {
+	err := sendWebhook(ctx, webhook, recordID)
+	if err == nil {
+		return nil
+	}
+	if _, ok := asFCMQuotaError(err); ok && requeueAfterQuota(ctx, webhook, recordID) {
+		return err
+	}
+	writeDeadLetter(ctx, webhook, err)
+	return err
+}
+
+// sendWebhook sends the notification for a webhook and records the outcome.
+func sendWebhook(ctx context.Context, webhook PretixWebhook, recordID int64) error {
+	if err := dispatch(ctx, webhook); err != nil {
+		slog.ErrorContext(ctx, "Error sending notification", append(webhookAttrs(webhook), "error", err)...)
+		recordSendResult(ctx, recordID, sendStatusFailed, err)
+		stats.Failed(webhook.Action)
+		return err
+	}
+
+	recordSendResult(ctx, recordID, sendStatusSent, nil)
+	stats.Sent(webhook.Action)
+	markProcessed(ctx, webhook)
+	observeDeliveryLag(ctx, webhook)
+	return nil
+}
+
+// observeDeliveryLag records how long after the event was created in Pretix
+// its notification went out. Webhooks without a created timestamp are
+// skipped.
+func observeDeliveryLag(ctx context.Context, webhook PretixWebhook) {
+	created, ok := webhook.CreatedAt()
+	if !ok {
+		if webhook.Created != "" {
+			slog.DebugContext(ctx, "Ignoring unparseable created timestamp",
+				append(webhookAttrs(webhook), "created", webhook.Created)...)
+		}
+		return
+	}
+
+	// Clock skew between Pretix and us can make the lag negative.
+	lag := max(time.Since(created), 0)
+	webhookDeliveryLag.WithLabelValues(webhook.Action).Observe(lag.Seconds())
+	slog.InfoContext(ctx, "Webhook delivered", append(webhookAttrs(webhook), "delivery_lag", lag.String())...)
+}
+
+// persistWebhook stores the webhook when a store is configured and returns
+// its record ID, or 0 if it was not stored. Failures are logged only so they
+// never block the FCM send.
+func persistWebhook(ctx context.Context, webhook PretixWebhook, body []byte, receivedAt time.Time) int64 {
+	if store == nil {
+		return 0
+	}
+
+	id, err := store.Insert(ctx, webhook, body, receivedAt)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error persisting webhook", append(webhookAttrs(webhook), "error", err)...)
+		return 0
+	}
+	return id
+}
+
+func recordSendResult(ctx context.Context, id int64, status string, sendErr error) {
+	if store == nil || id == 0 {
+		return
+	}
+
+	if err := store.RecordResult(ctx, id, status, sendErr); err != nil {
+		slog.ErrorContext(ctx, "Error recording send result", "record_id", id, "error", err)
+	}
+}
+
+// actionAllowed reports whether notifications should be sent for action.
+// The denylist takes precedence; an empty allowlist allows every action.
+func actionAllowed(action string) bool {
+	for _, pattern := range config.ActionDenylist {
+		if matchAction(pattern, action) {
+			return false
+		}
+	}
+	if len(config.ActionAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range config.ActionAllowlist {
+		if matchAction(pattern, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAction matches an action against an exact pattern or one ending in
+// "*", such as "pretix.event.order.*".
+func matchAction(pattern, action string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(action, prefix)
+	}
+	return pattern == action
+}
+
+// parseWebhook decodes a webhook payload. In strict mode unknown fields are
+// rejected; otherwise they are tolerated and logged at debug level.
+func parseWebhook(ctx context.Context, body []byte) (PretixWebhook, error) {
+	var webhook PretixWebhook
+
+	// RawBody keeps the original keys for clients and forwarding.
+	rawBody := body
+	if len(config.FieldMap) > 0 {
+		var err error
+		if body, err = remapFields(body); err != nil {
+			return webhook, err
+		}
+	}
+
+	if payloadSchema != nil {
+		if err := validateSchema(body); err != nil {
+			return webhook, err
+		}
+	}
+
+	if config.StrictJSON {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&webhook); err != nil {
+			return webhook, err
+		}
+		webhook.RawBody = rawBody
+		return webhook, nil
+	}
+
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return webhook, err
+	}
+	webhook.RawBody = rawBody
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		if unknown := unknownFields(body); len(unknown) > 0 {
+			slog.DebugContext(ctx, "Webhook payload contains unknown fields",
+				append(webhookAttrs(webhook), "fields", unknown)...)
+		}
+	}
+	return webhook, nil
+}
+
+// webhookFields returns the JSON keys PretixWebhook decodes.
+func webhookFields() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(PretixWebhook{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// remapFields renames keys in a webhook body according to FIELD_MAP, which
+// maps PretixWebhook's JSON keys to the keys a proxy sends instead. A key
+// that is already present under its standard name is left alone.
+func remapFields(body []byte) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	for field, source := range config.FieldMap {
+		value, ok := raw[source]
+		if !ok {
+			continue
+		}
+		delete(raw, source)
+		if _, exists := raw[field]; !exists {
+			raw[field] = value
+		}
+	}
+	return json.Marshal(raw)
+}
+
+// unknownFields lists top-level keys in body that PretixWebhook doesn't
+// model.
+func unknownFields(body []byte) []string {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil
+	}
+
+	known := webhookFields()
+	var unknown []string
+	for key := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// isTestPing reports whether the webhook is the test delivery Pretix sends
+// when a webhook is configured, identified by PRETIX_TEST_ACTION.
+func isTestPing(webhook PretixWebhook) bool {
+	return webhook.Action == config.PretixTestAction
+}
+
+// webhookAttrs returns the structured log fields identifying a webhook.
+func webhookAttrs(webhook PretixWebhook) []any {
+	attrs := []any{
+		"notification_id", webhook.NotificationID,
+		"organizer", webhook.Organizer,
+		"event", webhook.Event,
+		"action", webhook.Action,
+		"order_code", webhook.Code,
+		"status", webhook.Status,
+	}
+	if webhook.Email != "" {
+		attrs = append(attrs, "email", maskEmail(webhook.Email))
+	}
+	return attrs
+}
+
+// maskEmail hides all but the first character of an email's local part, e.g.
+// "jane@example.com" becomes "j***@example.com". Raw emails must never be
+// logged.
+func maskEmail(e string) string {
+	local, domain, ok := strings.Cut(e, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+	first, _ := utf8.DecodeRuneInString(local)
+	return string(first) + "***@" + domain
+}
+
+// loggableMessage returns a copy of msg that is safe to log: the device
+// token is shortened, emails in the data are masked and the raw payload,
+// which contains them too, is elided.
+func loggableMessage(msg *messaging.Message) *messaging.Message {
+	redacted := *msg
+	redacted.Token = truncate(msg.Token, 10)
+	redacted.Data = redactData(msg.Data)
+	if msg.APNS != nil && msg.APNS.Payload != nil {
+		apns := *msg.APNS
+		payload := *msg.APNS.Payload
+		customData := make(map[string]interface{}, len(payload.CustomData))
+		for k, v := range payload.CustomData {
+			customData[k] = v
+		}
+		for k, v := range redactData(msg.Data) {
+			if _, ok := customData[k]; ok {
+				customData[k] = v
+			}
+		}
+		payload.CustomData = customData
+		apns.Payload = &payload
+		redacted.APNS = &apns
+	}
+	return &redacted
+}
+
+func redactData(data map[string]string) map[string]string {
+	redacted := make(map[string]string, len(data))
+	for k, v := range data {
+		redacted[k] = v
+	}
+	if email := redacted["email"]; email != "" {
+		redacted["email"] = maskEmail(email)
+	}
+	if raw := redacted["raw_payload"]; raw != "" {
+		redacted["raw_payload"] = fmt.Sprintf("[%d bytes]", len(raw))
+	}
+	return redacted
+}
+
+// isBodyTooLarge reports whether err was caused by http.MaxBytesReader
+// hitting its limit.
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// checkWebhookSecret reports whether the request carries one of the
+// configured shared secrets, either in the X-Webhook-Secret header or the
+// secret query parameter. Several secrets are accepted so they can be
+// rotated without downtime. When no secret is configured every request is
+// accepted.
+func checkWebhookSecret(r *http.Request) bool {
+	if len(config.WebhookSecrets) == 0 {
+		return true
+	}
+
+	provided := r.Header.Get("X-Webhook-Secret")
+	if provided == "" {
+		provided = r.URL.Query().Get("secret")
+	}
+
+	// Every secret is compared so the timing doesn't reveal which matched.
+	matched := -1
+	for i, secret := range config.WebhookSecrets {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) == 1 && matched < 0 {
+			matched = i
+		}
+	}
+	if matched < 0 {
+		return false
+	}
+
+	slog.DebugContext(r.Context(), "Webhook secret matched", "secret_index", matched)
+	return true
+}
+
+// requireAdmin protects admin endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled entirely when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			writeJSONError(w, http.StatusForbidden, "Admin endpoints are disabled")
+			return
+		}
+
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(config.AdminToken)) != 1 {
+			slog.WarnContext(r.Context(), "Rejected admin request", "path", r.URL.Path, "client_ip", clientIP(r))
+			writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// verifySignature recomputes the HMAC-SHA256 of the raw request body and
+// compares it in constant time against the hex digest from the signature
+// header. An optional "sha256=" prefix on the header is accepted.
+func verifySignature(body []byte, header string, secret string) bool {
+	if header == "" {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// sendOrderNotification notifies about order actions, enriching the webhook
+// with order details from the Pretix API when configured.
+func sendOrderNotification(ctx context.Context, webhook PretixWebhook) error {
+	var buyerName, summary string
+	currency := config.DefaultCurrency
+	if details := fetchOrderDetails(ctx, webhook); details != nil {
+		summary = details.summary()
+		buyerName = details.BuyerName
+		if details.Currency != "" {
+			currency = details.Currency
+		}
+		if webhook.Status == "" {
+			webhook.Status = details.Status
+		}
+		if webhook.Total == "" {
+			webhook.Total = details.Total
+		}
+		if webhook.Email == "" {
+			webhook.Email = details.Email
+		}
+	}
+
+	var totalText string
+	if webhook.Total != "" {
+		var err error
+		if totalText, err = parseTotal(webhook.Total, currency); err != nil {
+			slog.WarnContext(ctx, "Error formatting order total", append(webhookAttrs(webhook), "error", err)...)
+		}
+	}
+
+	nc := notificationContext{
+		PretixWebhook: webhook,
+		Type:          webhookTypeOrder,
+		BuyerName:     buyerName,
+		Summary:       summary,
+		ActionTitle:   formatAction(webhook.Action),
+		TotalText:     totalText,
+	}
+
+	data := baseNotificationData(webhook)
+	data["status"] = webhook.Status
+	data["total"] = webhook.Total
+	data["total_formatted"] = totalText
+	data["currency"] = currency
+	if !config.ExcludeEmail {
+		data["email"] = webhook.Email
+	}
+	data["buyer_name"] = buyerName
+
+	return sendNotification(ctx, nc, data)
+}
+
+// baseNotificationData returns the data fields shared by every notification
+// type.
+func baseNotificationData(webhook PretixWebhook) map[string]string {
+	return map[string]string{
+		"notification_id": fmt.Sprintf("%d", webhook.NotificationID),
+		"organizer":       webhook.Organizer,
+		"event":           webhook.Event,
+		"action":          webhook.Action,
+		"order_code":      webhook.Code,
+	}
+}
+
+// sendNotification renders the title and body for nc and sends them with
+// data through every enabled notifier.
+func sendNotification(ctx context.Context, nc notificationContext, data map[string]string) error {
+	webhook := nc.PretixWebhook
+	locale := resolveLocale(webhook)
+	title, body := notificationText(ctx, nc, locale)
+
+	data["type"] = nc.Type
+	data["locale"] = locale
+	data["title"] = title
+	data["body"] = body
+	link := deepLink(ctx, nc)
+	if link != "" {
+		data["deep_link"] = link
+	}
+	addRawPayload(ctx, data, webhook)
+
+	return notify(ctx, Event{
+		Webhook:        webhook,
+		Type:           nc.Type,
+		Title:          title,
+		Body:           body,
+		CollapseKey:    collapseKey(ctx, nc),
+		Data:           data,
+		AnalyticsLabel: analyticsLabel(ctx, nc),
+		DeepLink:       link,
+	})
+}
+
+type messageIDsKey struct{}
+
+// messageIDs collects the IDs of FCM messages sent under a context, for
+// callers that report them back, like the stored webhook replay.
+type messageIDs struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func withMessageIDs(ctx context.Context) (context.Context, *messageIDs) {
+	ids := &messageIDs{}
+	return context.WithValue(ctx, messageIDsKey{}, ids), ids
+}
+
+// recordMessageID adds id to the context's collector, if any.
+func recordMessageID(ctx context.Context, id string) {
+	if ids, ok := ctx.Value(messageIDsKey{}).(*messageIDs); ok {
+		ids.mu.Lock()
+		ids.ids = append(ids.ids, id)
+		ids.mu.Unlock()
+	}
+}
+
+func (m *messageIDs) list() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.ids)
+}
+
+// sendToRecipients sends a built message through the webhook's FCM project to
+// the configured topic condition, or else to every resolved topic, and to any
+// direct device tokens.
+func sendToRecipients(ctx context.Context, message messaging.Message, webhook PretixWebhook) error {
+	project := resolveProject(webhook)
+	client := getFCMClient(project)
+
+	var errs []error
+	if config.FCMTopicCondition != "" {
+		msg := message
+		msg.Condition = config.FCMTopicCondition
+
+		start := time.Now()
+		response, err := sendWithRetry(ctx, client, &msg)
+		fcmSendDuration.Observe(time.Since(start).Seconds())
+		recordFCMResult(ctx, err)
+		if err != nil {
+			fcmSends.WithLabelValues("failure").Inc()
+			errs = append(errs, fmt.Errorf("error sending FCM message to condition %s: %w", msg.Condition, err))
+		} else {
+			fcmSends.WithLabelValues("success").Inc()
+			recordMessageID(ctx, response)
+			trace.SpanFromContext(ctx).AddEvent("FCM message sent", trace.WithAttributes(
+				attribute.String("fcm.condition", msg.Condition), attribute.String("fcm.message_id", response)))
+			slog.InfoContext(ctx, "FCM message sent successfully",
+				append(webhookAttrs(webhook), "project", project, "condition", msg.Condition, "message_id", response)...)
+		}
+	} else {
+		for _, topic := range resolveTopics(webhook) {
+			msg := message
+			msg.Topic = topic
+
+			start := time.Now()
+			response, err := sendWithRetry(ctx, client, &msg)
+			fcmSendDuration.Observe(time.Since(start).Seconds())
+			recordFCMResult(ctx, err)
+			if err != nil {
+				fcmSends.WithLabelValues("failure").Inc()
+				errs = append(errs, fmt.Errorf("error sending FCM message to topic %s: %w", topic, err))
+				continue
+			}
+
+			fcmSends.WithLabelValues("success").Inc()
+			recordMessageID(ctx, response)
+			trace.SpanFromContext(ctx).AddEvent("FCM message sent", trace.WithAttributes(
+				attribute.String("fcm.topic", topic), attribute.String("fcm.message_id", response)))
+			slog.InfoContext(ctx, "FCM message sent successfully",
+				append(webhookAttrs(webhook), "project", project, "topic", topic, "message_id", response)...)
+		}
+	}
+
+	if len(directTokens()) > 0 {
+		if err := sendToDevices(ctx, client, message, webhook); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// maxDataPayloadBytes is the FCM limit on the combined size of data keys and
+// values.
+const maxDataPayloadBytes = 4096
+
+// optionalDataKeys are dropped in this order when the data map exceeds the
+// FCM limit.
+var optionalDataKeys = []string{
+	"raw_payload",
+	"email",
+	"buyer_name",
+	"attendee_name",
+	"checkin_list",
+	"refund_reason",
+	"total_formatted",
+	"order_codes",
+}
+
+func dataPayloadSize(data map[string]string) int {
+	size := 0
+	for k, v := range data {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// withStaticData returns data merged with FCM_STATIC_DATA. Webhook fields win
+// on key collisions unless FCM_STATIC_DATA_OVERRIDE is set.
+func withStaticData(data map[string]string) map[string]string {
+	merged := make(map[string]string, len(data)+len(config.StaticData))
+	if config.StaticDataOverrides {
+		maps.Copy(merged, data)
+		maps.Copy(merged, config.StaticData)
+	} else {
+		maps.Copy(merged, config.StaticData)
+		maps.Copy(merged, data)
+	}
+	return merged
+}
+
+// fitDataPayload keeps the data map within the FCM size limit so the send
+// isn't rejected. Optional keys are dropped first; if that isn't enough, the
+// longest remaining values are truncated.
+func fitDataPayload(ctx context.Context, data map[string]string, webhook PretixWebhook) {
+	size := dataPayloadSize(data)
+	if size <= maxDataPayloadBytes {
+		return
+	}
+
+	var dropped, truncated []string
+	for _, key := range optionalDataKeys {
+		if size <= maxDataPayloadBytes {
+			break
+		}
+		if value, ok := data[key]; ok {
+			size -= len(key) + len(value)
+			delete(data, key)
+			dropped = append(dropped, key)
+		}
+	}
+
+	for size > maxDataPayloadBytes {
+		longest := ""
+		for k, v := range data {
+			if len(v) > len(data[longest]) || (len(v) == len(data[longest]) && k < longest) {
+				longest = k
+			}
+		}
+		value := data[longest]
+		// Only the keys are left, so there's nothing more to cut.
+		if len(value) == 0 {
+			break
+		}
+		keep := max(len(value)-(size-maxDataPayloadBytes), 0)
+		data[longest] = truncateUTF8(value, keep)
+		size -= len(value) - len(data[longest])
+		truncated = append(truncated, longest)
+	}
+
+	slog.WarnContext(ctx, "FCM data payload over size limit, trimmed",
+		append(webhookAttrs(webhook), "max_bytes", maxDataPayloadBytes, "dropped", dropped, "truncated", truncated)...)
+}
+
+// truncate shortens s to its first n bytes followed by "..." for logging
+// partial tokens and secrets. Strings of up to n bytes are returned as is.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return truncateUTF8(s, n) + "..."
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// addRawPayload adds the base64-encoded original request body to data when
+// enabled. FCM caps the data payload at 4KB, so bodies whose encoding
+// exceeds RawPayloadMaxBytes are omitted.
+func addRawPayload(ctx context.Context, data map[string]string, webhook PretixWebhook) {
+	if !config.IncludeRawPayload || len(webhook.RawBody) == 0 {
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(webhook.RawBody)
+	if len(encoded) > config.RawPayloadMaxBytes {
+		slog.WarnContext(ctx, "Raw payload too large for FCM data, omitting",
+			append(webhookAttrs(webhook), "encoded_bytes", len(encoded), "max_bytes", config.RawPayloadMaxBytes)...)
+		return
+	}
+	data["raw_payload"] = encoded
+}
+
+// maxMessageTTL is the longest time-to-live FCM accepts.
+const maxMessageTTL = 28 * 24 * time.Hour
+
+// messageTTL returns how long FCM should keep trying to deliver a
+// notification for action. Exact FCM_ACTION_TTLS entries win over wildcard
+// patterns, which win over FCM_TTL.
+func messageTTL(action string) time.Duration {
+	if ttl, ok := config.ActionTTLs[action]; ok {
+		return ttl
+	}
+
+	var best string
+	ttl := config.MessageTTL
+	for pattern, value := range config.ActionTTLs {
+		if strings.HasSuffix(pattern, "*") && matchAction(pattern, action) && len(pattern) > len(best) {
+			best, ttl = pattern, value
+		}
+	}
+	return ttl
+}
+
+// androidConfig builds the Android-specific delivery options. Actions in
+// AndroidHighPriority are escalated to high priority, and a deep link takes
+// the place of FCM_ANDROID_CLICK_ACTION.
+func androidConfig(webhook PretixWebhook, collapseKey string, ttl time.Duration, link string) *messaging.AndroidConfig {
+	priority := config.AndroidPriority
+	for _, pattern := range config.AndroidHighPriority {
+		if matchAction(pattern, webhook.Action) {
+			priority = "high"
+			break
+		}
+	}
+	if isVIPOrder(webhook) {
+		priority = "high"
+	}
+	clickAction := config.AndroidClickAction
+	if link != "" {
+		clickAction = link
+	}
+
+	return &messaging.AndroidConfig{
+		Priority:    priority,
+		CollapseKey: collapseKey,
+		TTL:         &ttl,
+		Notification: &messaging.AndroidNotification{
+			ChannelID:   androidChannel(webhook.Action),
+			Sound:       notificationSound(webhook, config.AndroidSound),
+			Icon:        config.AndroidIcon,
+			Color:       config.AndroidColor,
+			ClickAction: clickAction,
+		},
+	}
 }
 
-type Config struct {
-	Port                  string
-	FCMServiceAccountPath string
-	FCMProjectID          string
-	FCMTopic              string
+// androidChannel returns the action's FCM_ACTION_CHANNELS entry, or
+// FCM_ANDROID_CHANNEL_ID for unmapped actions.
+func androidChannel(action string) string {
+	if channel, ok := lookupAction(config.ActionChannels, action); ok {
+		return channel
+	}
+	return config.AndroidChannelID
 }
 
-var (
-	config    Config
-	fcmClient *messaging.Client
-)
+// isVIPOrder reports whether an order webhook's total reaches
+// FCM_VIP_TOTAL_THRESHOLD. Missing or unparseable totals never do.
+func isVIPOrder(webhook PretixWebhook) bool {
+	if config.VIPTotalThreshold <= 0 || webhookType(webhook.Action) != webhookTypeOrder {
+		return false
+	}
+	total, err := strconv.ParseFloat(strings.TrimSpace(webhook.Total), 64)
+	return err == nil && total >= config.VIPTotalThreshold
+}
 
-func loadConfig() {
-	godotenv.Load()
+// notificationSound returns FCM_VIP_SOUND for VIP orders when set, then the
+// action's FCM_ACTION_SOUNDS entry, and the platform's configured sound
+// otherwise. The same name is used on Android and iOS.
+func notificationSound(webhook PretixWebhook, sound string) string {
+	if config.VIPSound != "" && isVIPOrder(webhook) {
+		return config.VIPSound
+	}
+	if actionSound, ok := lookupAction(config.ActionSounds, webhook.Action); ok {
+		return actionSound
+	}
+	return sound
+}
 
-	config = Config{
-		Port:                  getEnvOrDefault("PORT", "8080"),
-		FCMServiceAccountPath: os.Getenv("FCM_SERVICE_ACCOUNT_PATH"),
-		FCMProjectID:          os.Getenv("FCM_PROJECT_ID"),
-		FCMTopic:              getEnvOrDefault("FCM_TOPIC", "pretix-orders"),
+// notificationImage returns the image URL for a webhook's notification:
+// FCM_IMAGE_MAP by "organizer/event", then "organizer", then FCM_IMAGE_URL.
+func notificationImage(webhook PretixWebhook) string {
+	for _, key := range []string{webhook.Organizer + "/" + webhook.Event, webhook.Organizer} {
+		if image, ok := config.ImageMapping[key]; ok {
+			return image
+		}
 	}
+	return config.ImageURL
+}
 
-	if config.FCMServiceAccountPath == "" {
-		log.Fatal("FCM_SERVICE_ACCOUNT_PATH environment variable is required")
+// isDataOnly reports whether notifications for action are sent as silent
+// data messages: always with FCM_DATA_ONLY, otherwise for actions matching
+// FCM_DATA_ONLY_ACTIONS.
+func isDataOnly(action string) bool {
+	if config.DataOnly {
+		return true
 	}
-	if config.FCMProjectID == "" {
-		log.Fatal("FCM_PROJECT_ID environment variable is required")
+	for _, pattern := range config.DataOnlyActions {
+		if matchAction(pattern, action) {
+			return true
+		}
 	}
+	return false
 }
 
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// makeDataOnly strips the displayed notification so clients receive only the
+// data map, which carries "title" and "body" for rendering their own UI. iOS
+// gets a background push that wakes the app.
+func makeDataOnly(message *messaging.Message) {
+	message.Notification = nil
+	if message.Android != nil {
+		message.Android.Notification = nil
+	}
+	if message.APNS != nil {
+		message.APNS.Headers["apns-push-type"] = "background"
+		message.APNS.Headers["apns-priority"] = "5"
+		message.APNS.FCMOptions = nil
+		message.APNS.Payload.Aps = &messaging.Aps{ContentAvailable: true}
 	}
-	return defaultValue
 }
 
-func initFCM() error {
-	ctx := context.Background()
+// applyImage attaches an image to the notification. iOS needs mutable-content
+// so the notification service extension can download it.
+func applyImage(message *messaging.Message, imageURL string) {
+	if imageURL == "" || message.Notification == nil {
+		return
+	}
 
-	opt := option.WithCredentialsFile(config.FCMServiceAccountPath)
-	app, err := firebase.NewApp(ctx, &firebase.Config{
-		ProjectID: config.FCMProjectID,
-	}, opt)
-	if err != nil {
-		return fmt.Errorf("error initializing firebase app: %v", err)
+	message.Notification.ImageURL = imageURL
+	if message.APNS != nil {
+		message.APNS.FCMOptions = &messaging.APNSFCMOptions{ImageURL: imageURL}
+		message.APNS.Payload.Aps.MutableContent = true
 	}
+}
 
-	fcmClient, err = app.Messaging(ctx)
+var androidColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// validateImageURL checks that an image URL is an absolute HTTPS URL, which
+// FCM requires.
+func validateImageURL(raw string) error {
+	u, err := url.Parse(raw)
 	if err != nil {
-		return fmt.Errorf("error getting messaging client: %v", err)
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("image URL must be an absolute https URL: %q", raw)
 	}
-
 	return nil
 }
 
-func handleWebhook(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method allowed", http.StatusMethodNotAllowed)
-		return
+// apnsConfig builds the iOS payload when APNS support is enabled. The data
+// map is repeated as custom keys so iOS clients can read it from the payload.
+func apnsConfig(title, body string, data map[string]string, collapseKey string, ttl time.Duration, sound, link string) *messaging.APNSConfig {
+	if !config.APNSEnabled {
+		return nil
 	}
 
-	body, err := io.ReadAll(r.Body)
+	customData := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		customData[k] = v
+	}
+	// Set apart from data, which may have been trimmed to fit FCM's limit.
+	if link != "" {
+		customData["deep_link"] = link
+	}
+
+	headers := map[string]string{
+		"apns-expiration": strconv.FormatInt(time.Now().Add(ttl).Unix(), 10),
+	}
+	if collapseKey != "" {
+		headers["apns-collapse-id"] = collapseKey
+	}
+
+	return &messaging.APNSConfig{
+		Headers: headers,
+		Payload: &messaging.APNSPayload{
+			Aps: &messaging.Aps{
+				Alert: &messaging.ApsAlert{
+					Title: title,
+					Body:  body,
+				},
+				Badge:            config.APNSBadge,
+				Sound:            sound,
+				ContentAvailable: true,
+			},
+			CustomData: customData,
+		},
+	}
+}
+
+// fetchOrderDetails enriches the webhook from the Pretix API when it is
+// configured. Failures are logged and nil is returned so callers fall back to
+// the minimal notification body.
+func fetchOrderDetails(ctx context.Context, webhook PretixWebhook) *orderDetails {
+	if pretix == nil || webhook.Code == "" {
+		return nil
+	}
+
+	details, err := pretix.fetchOrderDetails(ctx, webhook.Organizer, webhook.Event, webhook.Code)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
-		return
+		slog.WarnContext(ctx, "Error fetching order details from Pretix API",
+			append(webhookAttrs(webhook), "error", err)...)
+		return nil
 	}
-	defer r.Body.Close()
+	return details
+}
 
-	var webhook PretixWebhook
-	if err := json.Unmarshal(body, &webhook); err != nil {
-		log.Printf("Error parsing webhook payload: %v", err)
-		http.Error(w, "Error parsing payload", http.StatusBadRequest)
-		return
+// resolveTopics returns the FCM topics a webhook should be delivered to.
+// TopicMapping keys are either "organizer/event" or just "organizer", and
+// values may list several comma-separated topics. When nothing matches the
+// default FCMTopic is used. A TypeTopics entry for the webhook's type (e.g.
+// "checkin") takes precedence over TopicMapping, and an ActionTopics entry
+// for its action over both. FCM_TOPIC_CONDITION, when set, replaces topics
+// entirely.
+func resolveTopics(webhook PretixWebhook) []string {
+	var topics []string
+	seen := make(map[string]bool)
+
+	values := []string{
+		config.TopicMapping[webhook.Organizer+"/"+webhook.Event],
+		config.TopicMapping[webhook.Organizer],
+	}
+	if value, ok := lookupAction(config.ActionTopics, webhook.Action); ok {
+		values = []string{value}
+	} else if value, ok := config.TypeTopics[webhookType(webhook.Action)]; ok {
+		values = []string{value}
 	}
+	for _, value := range values {
+		for _, topic := range strings.Split(value, ",") {
+			topic = strings.TrimSpace(topic)
+			if topic != "" && !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	if len(topics) == 0 {
+		topics = append(topics, config.FCMTopic)
+	}
+	if config.VIPTopic != "" && !seen[config.VIPTopic] && isVIPOrder(webhook) {
+		topics = append(topics, config.VIPTopic)
+	}
+	return topics
+}
 
-	log.Printf("Received webhook: organizer=%s, event=%s, action=%s, order=%s, status=%s",
-		webhook.Organizer, webhook.Event, webhook.Action, webhook.Code, webhook.Status)
+// sendWithRetry sends msg via FCM, retrying transient failures with
+// exponential backoff and jitter. Permanent errors are returned immediately.
+func sendWithRetry(ctx context.Context, client *messaging.Client, msg *messaging.Message) (string, error) {
+	var lastErr error
+	for attempt := 0; attempt <= config.FCMMaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(config.FCMRetryBaseDelay, attempt)
+			slog.WarnContext(ctx, "Retrying FCM send", "delay", delay.String(),
+				"attempt", attempt+1, "max_attempts", config.FCMMaxRetries+1, "error", lastErr)
 
-	if err := sendFCMNotification(webhook); err != nil {
-		log.Printf("Error sending FCM notification: %v", err)
-		http.Error(w, "Error processing webhook", http.StatusInternalServerError)
-		return
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		response, err := sendFCM(ctx, client, msg)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+
+		if errors.Is(err, context.DeadlineExceeded) || !isRetryableFCMError(err) {
+			break
+		}
 	}
+	return "", lastErr
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Webhook processed successfully"))
+// maxRetryDelay caps the exponential backoff between retries, so a large
+// FCM_MAX_RETRIES or FORWARD_MAX_RETRIES can't overflow the delay or stall a
+// send for hours.
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay returns the jittered delay before retry attempt (counting from
+// 1): base doubled for each earlier retry, capped at maxRetryDelay.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryDelay)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
 
-func sendFCMNotification(webhook PretixWebhook) error {
-	ctx := context.Background()
+// sendSlots bounds the number of concurrent FCM sends to
+// FCM_MAX_CONCURRENT_SENDS. It is nil when sends are unbounded.
+var sendSlots chan struct{}
 
-	title := fmt.Sprintf("Order %s", formatAction(webhook.Action))
-	body := fmt.Sprintf("Order %s from %s", webhook.Code, webhook.Event)
-	if webhook.Status != "" {
-		body += fmt.Sprintf(" - %s", webhook.Status)
+// acquireSendSlot blocks until a send may start or ctx is done. The returned
+// function releases the slot.
+func acquireSendSlot(ctx context.Context) (func(), error) {
+	if sendSlots != nil {
+		select {
+		case sendSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	if webhook.Total != "" {
-		body += fmt.Sprintf(" (Total: %s)", webhook.Total)
+
+	fcmSendsInFlight.Inc()
+	return func() {
+		fcmSendsInFlight.Dec()
+		if sendSlots != nil {
+			<-sendSlots
+		}
+	}, nil
+}
+
+// sendFCM performs a single FCM send bounded by config.FCMTimeout. A timeout
+// is reported as an error wrapping context.DeadlineExceeded.
+func sendFCM(ctx context.Context, client *messaging.Client, msg *messaging.Message) (string, error) {
+	if config.DryRun {
+		slog.InfoContext(ctx, "Dry run, FCM message not sent", "message", loggableMessage(msg))
+		return "dry-run", nil
 	}
 
-	message := &messaging.Message{
-		Topic: config.FCMTopic,
-		Notification: &messaging.Notification{
-			Title: title,
-			Body:  body,
-		},
-		Data: map[string]string{
-			"notification_id": fmt.Sprintf("%d", webhook.NotificationID),
-			"organizer":       webhook.Organizer,
-			"event":           webhook.Event,
-			"action":          webhook.Action,
-			"order_code":      webhook.Code,
-			"status":          webhook.Status,
-			"total":           webhook.Total,
-			"email":           webhook.Email,
-		},
+	if retryAfter := fcmRetryAfter(); retryAfter > 0 {
+		return "", &fcmQuotaError{retryAfter: retryAfter}
+	}
+	if batcher != nil {
+		return batcher.send(ctx, client, msg)
 	}
 
-	response, err := fcmClient.Send(ctx, message)
+	release, err := acquireSendSlot(ctx)
 	if err != nil {
-		return fmt.Errorf("error sending FCM message: %v", err)
+		return "", err
 	}
+	defer release()
 
-	log.Printf("FCM message sent successfully: %s", response)
-	return nil
+	sendCtx, cancel := context.WithTimeout(ctx, config.FCMTimeout)
+	defer cancel()
+
+	response, err := client.Send(sendCtx, msg)
+	trackFCMAuthFailure(ctx, err)
+	if isFCMQuotaError(err) {
+		return "", throttleFCM(ctx, err)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("webhook processing deadline exceeded during FCM send: %w", context.DeadlineExceeded)
+	}
+	if err != nil && errors.Is(sendCtx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("FCM send timed out after %s: %w", config.FCMTimeout, context.DeadlineExceeded)
+	}
+	return response, err
+}
+
+func isRetryableFCMError(err error) bool {
+	return messaging.IsUnavailable(err) || messaging.IsInternal(err)
 }
 
+// formatAction turns a Pretix action like "pretix.event.order.placed.require_approval"
+// into a readable title like "Placed Require Approval". The leading
+// "pretix.event." is dropped, the object segment ("order", "checkin") is kept
+// only when FCM_ACTION_TITLE_INCLUDE_OBJECT is set, and words listed in
+// FCM_ACTION_ACRONYMS keep their upper case.
 func formatAction(action string) string {
-	parts := strings.Split(action, ".")
-	if len(parts) > 0 {
-		lastPart := strings.ReplaceAll(parts[len(parts)-1], "_", " ")
-		// Capitalize first letter of each word
-		words := strings.Fields(lastPart)
-		for i, word := range words {
-			if len(word) > 0 {
-				words[i] = strings.ToUpper(string(word[0])) + strings.ToLower(word[1:])
-			}
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(action, "pretix."), "event.")
+	parts := strings.Split(trimmed, ".")
+
+	object, details := parts[0], parts[1:]
+	segments := details
+	if config.ActionTitleIncludeObject || len(details) == 0 {
+		segments = parts
+	}
+
+	var words []string
+	for _, segment := range segments {
+		for _, word := range strings.Fields(strings.ReplaceAll(segment, "_", " ")) {
+			words = append(words, formatWord(word))
 		}
-		return strings.Join(words, " ")
 	}
-	return action
+	if len(words) == 0 {
+		return formatWord(object)
+	}
+	return strings.Join(words, " ")
+}
+
+func formatWord(word string) string {
+	if word == "" {
+		return word
+	}
+	if config.ActionAcronyms[strings.ToUpper(word)] {
+		return strings.ToUpper(word)
+	}
+	// Capitalize first letter of each word
+	return strings.ToUpper(word[:1]) + strings.ToLower(word[1:])
+}
+
+// writeJSONError writes an error response with a consistent JSON shape:
+// {"error": "...", "status": 400}.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  message,
+		"status": status,
+	})
+}
+
+// writeJSONErrorFields is writeJSONError with the individual field errors
+// behind it.
+func writeJSONErrorFields(w http.ResponseWriter, status int, message string, fields []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  message,
+		"status": status,
+		"fields": fields,
+	})
 }
 
 func healthCheck(w http.ResponseWriter, r *http.Request) {
+	if redisClient != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), redisTimeout)
+		defer cancel()
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			slog.WarnContext(r.Context(), "Health check failed, Redis unreachable", "error", err)
+			writeJSONError(w, http.StatusServiceUnavailable, "Redis unreachable")
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-func testFCMToken(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method allowed", http.StatusMethodNotAllowed)
+// readinessCheck reports whether the service can deliver notifications: the
+// health check passes and, when FCM is enabled, its clients are initialized.
+func readinessCheck(w http.ResponseWriter, r *http.Request) {
+	if notifierEnabled(notifierFCM) && !fcmReady.Load() {
+		writeJSONError(w, http.StatusServiceUnavailable, "FCM is not initialized")
 		return
 	}
+	healthCheck(w, r)
+}
 
+func testFCMToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	// Parse device token from request body
 	var request struct {
 		Token   string `json:"token"`
@@ -193,51 +2575,51 @@ func testFCMToken(w http.ResponseWriter, r *http.Request) {
 		Message string `json:"message,omitempty"`
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		if isBodyTooLarge(err) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON payload")
 		return
 	}
 
 	if request.Token == "" {
-		http.Error(w, "Device token is required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Device token is required")
 		return
 	}
-
-	// Set default test message if not provided
-	title := request.Title
-	if title == "" {
-		title = "Test FCM Message"
-	}
-	messageBody := request.Message
-	if messageBody == "" {
-		messageBody = "This is a test message from your webhook service"
+	if err := validateDeviceToken(request.Token); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid device token: %v", err))
+		return
 	}
 
+	title, messageBody, locale := testMessageText(r, request.Title, request.Message)
+
 	// Create FCM message for direct device token
-	ctx := context.Background()
 	message := &messaging.Message{
 		Token: request.Token,
 		Notification: &messaging.Notification{
 			Title: title,
 			Body:  messageBody,
 		},
-		Data: map[string]string{
-			"test":      "true",
-			"timestamp": fmt.Sprintf("%d", time.Now().Unix()),
-			"source":    "webhook-test-endpoint",
-		},
+		Data: testMessageData(locale),
 	}
 
 	// Send the message
-	response, err := fcmClient.Send(ctx, message)
+	response, err := sendFCM(ctx, getFCMClient(defaultFCMProject), message)
 	if err != nil {
-		log.Printf("Error sending test FCM message: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to send message: %v", err), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error sending test FCM message", "error", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeJSONError(w, http.StatusGatewayTimeout, "Timed out sending message")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to send message: %v", err))
 		return
 	}
 
-	log.Printf("Test FCM message sent successfully to token: %s, response: %s",
-		request.Token[:10]+"...", response)
+	slog.InfoContext(ctx, "Test FCM message sent successfully",
+		"token", truncate(request.Token, 10), "message_id", response)
 
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
@@ -248,21 +2630,457 @@ func testFCMToken(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// testMessageText fills in the default test title and body, localized via
+// ?lang=, where the request leaves them empty.
+func testMessageText(r *http.Request, title, body string) (string, string, string) {
+	locale := r.URL.Query().Get("lang")
+	if _, ok := testMessages[locale]; !ok {
+		locale = config.DefaultLocale
+	}
+	defaults, ok := testMessages[locale]
+	if !ok {
+		defaults = testMessages["en"]
+	}
+
+	if title == "" {
+		title = defaults.Title
+	}
+	if body == "" {
+		body = defaults.Body
+	}
+	return title, body, locale
+}
+
+func testMessageData(locale string) map[string]string {
+	return withStaticData(map[string]string{
+		"test":      "true",
+		"timestamp": fmt.Sprintf("%d", time.Now().Unix()),
+		"source":    "webhook-test-endpoint",
+		"locale":    locale,
+	})
+}
+
+// maxTestBulkTokens caps the tokens per /test-fcm-bulk request.
+const maxTestBulkTokens = 100
+
+// testFCMBulk sends a test message to several device tokens in one
+// multicast, reporting the outcome for each token. Invalid tokens are
+// reported as failed without being sent.
+func testFCMBulk(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var request struct {
+		Tokens  []string `json:"tokens"`
+		Title   string   `json:"title,omitempty"`
+		Message string   `json:"message,omitempty"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if isBodyTooLarge(err) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+
+	if len(request.Tokens) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "At least one device token is required")
+		return
+	}
+	if len(request.Tokens) > maxTestBulkTokens {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("At most %d device tokens are allowed", maxTestBulkTokens))
+		return
+	}
+
+	type tokenResult struct {
+		Token     string `json:"token"`
+		Success   bool   `json:"success"`
+		MessageID string `json:"message_id,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	results := make([]tokenResult, len(request.Tokens))
+	var valid []string
+	var validIndexes []int
+	for i, token := range request.Tokens {
+		results[i].Token = token
+		if err := validateDeviceToken(token); err != nil {
+			results[i].Error = fmt.Sprintf("invalid device token: %v", err)
+			continue
+		}
+		valid = append(valid, token)
+		validIndexes = append(validIndexes, i)
+	}
+
+	if len(valid) > 0 {
+		title, messageBody, locale := testMessageText(r, request.Title, request.Message)
+		message := &messaging.MulticastMessage{
+			Tokens:       valid,
+			Notification: &messaging.Notification{Title: title, Body: messageBody},
+			Data:         testMessageData(locale),
+		}
+
+		if config.DryRun {
+			slog.InfoContext(ctx, "Dry run, test FCM multicast not sent", "tokens", len(valid))
+			for _, i := range validIndexes {
+				results[i].Success, results[i].MessageID = true, "dry-run"
+			}
+		} else {
+			if retryAfter := fcmRetryAfter(); retryAfter > 0 {
+				writeThrottled(w, retryAfter)
+				return
+			}
+			release, err := acquireSendSlot(ctx)
+			if err != nil {
+				writeJSONError(w, http.StatusServiceUnavailable, "Error acquiring send slot")
+				return
+			}
+			sendCtx, cancel := context.WithTimeout(ctx, config.FCMTimeout)
+			response, err := getFCMClient(defaultFCMProject).SendEachForMulticast(sendCtx, message)
+			cancel()
+			release()
+			trackFCMAuthFailure(ctx, err)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error sending test FCM multicast", "error", err)
+				if errors.Is(err, context.DeadlineExceeded) {
+					writeJSONError(w, http.StatusGatewayTimeout, "Timed out sending message")
+					return
+				}
+				writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to send message: %v", err))
+				return
+			}
+			for j, resp := range response.Responses {
+				i := validIndexes[j]
+				results[i].Success, results[i].MessageID = resp.Success, resp.MessageID
+				if resp.Error != nil {
+					results[i].Error = resp.Error.Error()
+				}
+			}
+		}
+	}
+
+	succeeded := 0
+	for _, result := range results {
+		if result.Success {
+			succeeded++
+		}
+	}
+	failed := len(results) - succeeded
+	slog.InfoContext(ctx, "Test FCM multicast sent", "tokens", len(results), "succeeded", succeeded, "failed", failed)
+
+	status := http.StatusOK
+	if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"succeeded": succeeded,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// logWriter returns the log destination: stderr, or LOG_FILE with size and
+// age based rotation. File logs are mirrored to stderr when LOG_STDERR is set,
+// which defaults to true when stderr is a terminal.
+func logWriter() io.Writer {
+	if config.LogFile == "" {
+		return os.Stderr
+	}
+
+	file := &lumberjack.Logger{
+		Filename:   config.LogFile,
+		MaxSize:    config.LogMaxSizeMB,
+		MaxBackups: config.LogMaxBackups,
+		MaxAge:     config.LogMaxAgeDays,
+		Compress:   config.LogCompress,
+	}
+	if config.LogStderr {
+		return io.MultiWriter(file, os.Stderr)
+	}
+	return file
+}
+
+// registerRoutes adds the service's endpoints under base to mux. Metrics
+// are registered separately as they may be served on their own port.
+func registerRoutes(mux *http.ServeMux, base string) {
+	// Everything but the health check and metrics is rate limited so probes
+	// and scrapers are never throttled. The method patterns make the mux answer
+	// other methods with 405 and an Allow header listing the registered ones.
+	mux.HandleFunc("POST "+base+"/webhook", traceRequest("POST /webhook", requireAllowedIP(rateLimit(handleWebhook))))
+	mux.HandleFunc("GET "+base+"/health", cors(healthCheck))
+	mux.HandleFunc("GET "+base+"/readyz", cors(readinessCheck))
+	mux.HandleFunc("GET "+base+"/version", cors(rateLimit(handleVersion)))
+	mux.HandleFunc("GET "+base+"/stats", cors(rateLimit(requireAdmin(handleStats))))
+	mux.HandleFunc("POST "+base+"/replay", cors(rateLimit(requireAdmin(handleReplay))))
+	mux.HandleFunc("POST "+base+"/replay/{notification_id}", cors(rateLimit(requireAdmin(handleReplayStored))))
+	mux.HandleFunc("GET "+base+"/config", cors(rateLimit(requireAdmin(handleConfig))))
+	mux.HandleFunc("GET "+base+"/events", cors(rateLimit(requireAdmin(handleEvents))))
+	corsPaths := []string{"/health", "/readyz", "/version", "/stats", "/replay", "/replay/{notification_id}", "/config", "/events"}
+	// The FCM endpoints need FCM clients, which aren't created when the FCM
+	// notifier is disabled.
+	if notifierEnabled(notifierFCM) {
+		mux.HandleFunc("POST "+base+"/test-fcm", cors(rateLimit(requireFCMReady(testFCMToken))))
+		mux.HandleFunc("POST "+base+"/test-fcm-bulk", cors(rateLimit(requireAdmin(requireFCMReady(testFCMBulk)))))
+		mux.HandleFunc("POST "+base+"/admin/reload-credentials", cors(rateLimit(requireAdmin(handleReloadCredentials))))
+		mux.HandleFunc("POST "+base+"/register", cors(rateLimit(requireAdmin(requireFCMReady(handleRegister)))))
+		mux.HandleFunc("DELETE "+base+"/register", cors(rateLimit(requireAdmin(requireFCMReady(handleUnregister)))))
+		corsPaths = append(corsPaths, "/test-fcm", "/test-fcm-bulk", "/admin/reload-credentials", "/register")
+	}
+
+	// Browser preflights for the endpoints above. /webhook is server to server
+	// and deliberately has no CORS support.
+	for _, path := range corsPaths {
+		mux.HandleFunc("OPTIONS "+base+path, cors(handlePreflight))
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func main() {
 	loadConfig()
 
-	if err := initFCM(); err != nil {
-		log.Fatalf("Failed to initialize FCM: %v", err)
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(logWriter(), &slog.HandlerOptions{
+		Level: config.LogLevel,
+	})}))
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		fatal("Failed to initialize tracing", "error", err)
+	}
+
+	if notifierEnabled(notifierFCM) {
+		if err := initFCM(); err != nil {
+			slog.Error("Failed to initialize FCM, starting in degraded mode", "error", err)
+			go retryInitFCM()
+		} else if config.StartupSelfTest {
+			if err := selfTestFCM(context.Background()); err != nil {
+				if config.StartupSelfTestFatal {
+					fatal("Startup self-test failed", "error", err)
+				}
+				slog.Error("Startup self-test failed", "error", err)
+			}
+		}
+	}
+	if notifiers, err = newNotifiers(config.Notifiers); err != nil {
+		fatal("Invalid NOTIFIERS", "error", err)
+	}
+
+	tokens, err := newFileTokenStore(config.DeviceTokens, config.DeviceTokensFile)
+	if err != nil {
+		fatal("Failed to load device tokens", "error", err)
+	}
+	tokenStore = tokens
+
+	if config.RedisURL != "" {
+		client, err := newRedisClient(config.RedisURL)
+		if err != nil {
+			fatal("Failed to connect to Redis", "error", err)
+		}
+		redisClient = client
+		defer redisClient.Close()
+
+		if config.DedupTTL > 0 {
+			dedup = newRedisDedupStore(redisClient, config.DedupTTL)
+		}
+	}
+
+	if config.DBPath != "" {
+		sqlStore, err := newSQLiteStore(config.DBPath)
+		if err != nil {
+			fatal("Failed to open webhook store", "path", config.DBPath, "error", err)
+		}
+		store = sqlStore
+		defer store.Close()
+
+		if dedup == nil && config.DedupTTL > 0 {
+			if dedup, err = newSQLiteDedupStore(sqlStore.db, config.DedupTTL); err != nil {
+				fatal("Failed to open dedup store", "path", config.DBPath, "error", err)
+			}
+		}
+	}
+	if dedup == nil && config.DedupTTL > 0 {
+		dedup = newMemoryDedupStore(config.DedupTTL)
+	}
+
+	if config.AsyncProcessing {
+		if redisClient != nil {
+			queue = newRedisQueue(redisClient, config.WorkerCount, config.QueueSize)
+		} else {
+			queue = newWebhookQueue(config.WorkerCount, config.QueueSize)
+		}
+	}
+
+	if config.AggregationWindow > 0 {
+		aggregator = newWebhookAggregator(config.AggregationWindow, config.AggregateActions)
+	}
+	if config.CooldownWindow > 0 {
+		cooldown = newEventCooldown(config.CooldownWindow, config.CooldownActions)
+	}
+	if config.ForwardURL != "" {
+		forwarder = newWebhookForwarder()
+	}
+
+	if config.ValidateSchema {
+		var err error
+		if payloadSchema, err = compileWebhookSchema(); err != nil {
+			fatal("Error compiling webhook schema", "error", err)
+		}
+	}
+
+	if config.QuietHours != "" {
+		var err error
+		if quiet, err = newQuietHours(config.QuietHours, config.QuietHoursQueue); err != nil {
+			fatal("Invalid QUIET_HOURS", "error", err)
+		}
+	}
+
+	if config.PretixAPIURL != "" && config.PretixAPIToken != "" {
+		pretix = newPretixClient(config.PretixAPIURL, config.PretixAPIToken, config.PretixAPITimeout)
+	}
+
+	base := config.BasePath
+	mux := http.NewServeMux()
+	if config.MaxConcurrentSends > 0 {
+		sendSlots = make(chan struct{}, config.MaxConcurrentSends)
+	}
+	if config.FCMBatchInterval > 0 {
+		batcher = newFCMBatcher(config.FCMBatchSize, config.FCMBatchInterval)
+	}
+	if config.AlertWebhookURL != "" {
+		alerter = newFCMAlerter(config.AlertWebhookURL, config.AlertFailureThreshold, config.AlertFailureWindow, config.AlertTimeout)
+	}
+
+	if config.RateLimit > 0 {
+		limiter = newIPRateLimiter(rate.Limit(config.RateLimit), config.RateLimitBurst)
+	}
+
+	registerRoutes(mux, base)
+
+	metricsPath := base + "/metrics"
+	if config.MetricsPort == "" || config.MetricsPort == config.Port {
+		mux.Handle("GET "+metricsPath, promhttp.Handler())
+	} else {
+		// The dedicated metrics port isn't behind the ingress, so it ignores
+		// BASE_PATH.
+		metricsPath = "/metrics"
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET "+metricsPath, promhttp.Handler())
+		go func() {
+			slog.Info("Metrics server starting", "port", config.MetricsPort)
+			if err := http.ListenAndServe(":"+config.MetricsPort, metricsMux); err != nil {
+				fatal("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	build := currentBuildInfo()
+	slog.Info("Server starting", "version", build.Version, "commit", build.Commit, "app_env", config.AppEnv, "port", config.Port, "base_path", base, "endpoints", []string{
+		"POST " + base + "/webhook - Pretix webhook handler",
+		"GET  " + base + "/health - Health check",
+		"GET  " + base + "/readyz - Readiness check (FCM initialized)",
+		"GET  " + base + "/version - Build information",
+		"GET  " + base + "/stats - In-memory webhook counters (admin)",
+		"POST " + base + "/test-fcm - Test FCM with device token",
+		"POST " + base + "/test-fcm-bulk - Test FCM with up to 100 device tokens (admin)",
+		"POST " + base + "/replay - Replay dead-lettered notifications (admin)",
+		"POST " + base + "/replay/{notification_id} - Re-send a stored webhook's notification (admin)",
+		"GET  " + base + "/config - Effective configuration, secrets redacted (admin)",
+		"GET  " + base + "/events - Stored webhooks and send outcomes (admin)",
+		"POST " + base + "/admin/reload-credentials - Reload FCM credentials (admin)",
+		"POST " + base + "/register - Register a device token (admin)",
+		"DELETE " + base + "/register - Unregister a device token (admin)",
+		"GET  " + metricsPath + " - Prometheus metrics",
+	})
+
+	handler := recoverPanics(mux)
+	if config.AccessLog {
+		handler = accessLog(handler)
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		fatal("Invalid TLS configuration", "error", err)
+	}
+
+	server := &http.Server{
+		Addr:              ":" + config.Port,
+		Handler:           withRequestID(handler),
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
 	}
 
-	http.HandleFunc("/webhook", handleWebhook)
-	http.HandleFunc("/health", healthCheck)
-	http.HandleFunc("/test-fcm", testFCMToken)
+	go func() {
+		var err error
+		switch {
+		case acmeManager != nil:
+			slog.Info("Serving HTTPS with ACME certificates", "hosts", config.ACMEHosts, "min_version", config.TLSMinVersion)
+			err = server.ListenAndServeTLS("", "")
+		case tlsConfig != nil:
+			slog.Info("Serving HTTPS", "cert_file", config.TLSCertFile, "min_version", config.TLSMinVersion)
+			err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		default:
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Server error", "error", err)
+		}
+	}()
+
+	var acmeServer *http.Server
+	if acmeManager != nil {
+		acmeServer = newACMEHTTPServer()
+		go func() {
+			slog.Info("ACME challenge and HTTPS redirect server starting", "port", config.ACMEHTTPPort)
+			if err := acmeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("ACME HTTP server error", "error", err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
 
-	log.Printf("Server starting on port %s", config.Port)
-	log.Printf("Available endpoints:")
-	log.Printf("  POST /webhook - Pretix webhook handler")
-	log.Printf("  GET  /health - Health check")
-	log.Printf("  POST /test-fcm - Test FCM with device token")
-	log.Fatal(http.ListenAndServe(":"+config.Port, nil))
+	slog.Info("Shutting down gracefully", "timeout", config.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if acmeServer != nil {
+		if err := acmeServer.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down ACME HTTP server", "error", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		fatal("Graceful shutdown failed", "error", err)
+	}
+	if aggregator != nil {
+		slog.Info("Flushing pending aggregated notifications")
+		aggregator.close()
+	}
+	if cooldown != nil {
+		slog.Info("Sending pending cooldown summaries")
+		cooldown.close()
+	}
+	if quiet != nil {
+		quiet.close()
+	}
+	if queue != nil {
+		slog.Info("Draining webhook queue", "pending", queue.Pending())
+		queue.Close()
+	}
+	if batcher != nil {
+		batcher.close()
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// loadTestConfig loads the configuration from env on top of the defaults and
+// restores the previous configuration when the test ends.
+func loadTestConfig(t *testing.T, env map[string]string) {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	saved := config
+	t.Cleanup(func() { config = saved })
+	loadConfig()
+}
+
+func TestFormatAction(t *testing.T) {
+	loadTestConfig(t, nil)
+
+	tests := []struct {
+		action string
+		want   string
+	}{
+		{"pretix.event.order.placed", "Placed"},
+		{"pretix.event.order.placed.require_approval", "Placed Require Approval"},
+		{"pretix.event.order.paid", "Paid"},
+		{"pretix.event.order.canceled", "Canceled"},
+		{"pretix.event.order.reactivated", "Reactivated"},
+		{"pretix.event.order.expired", "Expired"},
+		{"pretix.event.order.modified", "Modified"},
+		{"pretix.event.order.contact.changed", "Contact Changed"},
+		{"pretix.event.order.changed.item", "Changed Item"},
+		{"pretix.event.order.refund.created.externally", "Refund Created Externally"},
+		{"pretix.event.order.approved", "Approved"},
+		{"pretix.event.order.denied", "Denied"},
+		{"pretix.event.order.data_changed", "Data Changed"},
+		{"pretix.event.checkin", "Checkin"},
+		{"pretix.event.checkin.reverted", "Reverted"},
+		{"pretix.event.added", "Added"},
+		{"pretix.event.order.vat_id.changed", "VAT ID Changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			if got := formatAction(tt.action); got != tt.want {
+				t.Errorf("formatAction(%q) = %q, want %q", tt.action, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatActionIncludeObject(t *testing.T) {
+	loadTestConfig(t, map[string]string{"FCM_ACTION_TITLE_INCLUDE_OBJECT": "true"})
+
+	if got, want := formatAction("pretix.event.order.paid"), "Order Paid"; got != want {
+		t.Errorf("formatAction() = %q, want %q", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := PretixWebhook{Organizer: "gdg", Event: "devfest", Code: "ABC12", Action: "pretix.event.order.placed"}
+
+	tests := []struct {
+		name    string
+		modify  func(*PretixWebhook)
+		missing string
+	}{
+		{"valid", func(*PretixWebhook) {}, ""},
+		{"missing organizer", func(w *PretixWebhook) { w.Organizer = "" }, "organizer"},
+		{"missing event", func(w *PretixWebhook) { w.Event = "" }, "event"},
+		{"missing action", func(w *PretixWebhook) { w.Action = "" }, "action"},
+		{"missing order code", func(w *PretixWebhook) { w.Code = "" }, "code"},
+		{"event action without code", func(w *PretixWebhook) { w.Code, w.Action = "", "pretix.event.added" }, ""},
+		{"several missing", func(w *PretixWebhook) { w.Organizer, w.Event = "", "" }, "organizer, event"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook := valid
+			tt.modify(&webhook)
+			err := webhook.Validate()
+			if tt.missing == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != "missing required fields: "+tt.missing {
+				t.Errorf("Validate() = %v, want missing %s", err, tt.missing)
+			}
+		})
+	}
+}
+
+// testServiceAccount returns service account credentials for projectID with
+// a freshly generated key.
+func testServiceAccount(t *testing.T, projectID string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     projectID,
+		"private_key_id": "test",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "pretix-webhook@" + projectID + ".iam.gserviceaccount.com",
+		"client_id":      "1",
+		"token_uri":      "https://oauth2.googleapis.com/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(credentials)
+}
+
+func TestNewFCMClientInlineJSON(t *testing.T) {
+	loadTestConfig(t, nil)
+
+	client, err := newFCMClient(context.Background(), fcmProject{
+		ProjectID:          "gultix-test",
+		ServiceAccountJSON: testServiceAccount(t, "gultix-test"),
+	})
+	if err != nil {
+		t.Fatalf("newFCMClient() error = %v", err)
+	}
+	if client == nil {
+		t.Fatal("newFCMClient() returned a nil client")
+	}
+}
+
+func TestNewFCMClientInvalidInlineJSON(t *testing.T) {
+	loadTestConfig(t, nil)
+
+	if _, err := newFCMClient(context.Background(), fcmProject{ServiceAccountJSON: "{not json"}); err == nil {
+		t.Fatal("newFCMClient() succeeded with malformed credentials")
+	}
+}
+
+func TestFitDataPayload(t *testing.T) {
+	ctx := context.Background()
+	webhook := PretixWebhook{Organizer: "gdg", Event: "devfest", Code: "ABC12", Action: "pretix.event.order.placed"}
+
+	t.Run("under limit", func(t *testing.T) {
+		data := map[string]string{"code": "ABC12", "raw_payload": `{"code":"ABC12"}`}
+		fitDataPayload(ctx, data, webhook)
+		if data["raw_payload"] == "" || data["code"] != "ABC12" {
+			t.Errorf("fitDataPayload() changed a payload within the limit: %v", data)
+		}
+	})
+
+	t.Run("drops optional keys first", func(t *testing.T) {
+		data := map[string]string{
+			"code":        "ABC12",
+			"email":       "buyer@example.com",
+			"raw_payload": strings.Repeat("x", maxDataPayloadBytes),
+		}
+		fitDataPayload(ctx, data, webhook)
+		if _, ok := data["raw_payload"]; ok {
+			t.Error("raw_payload was kept")
+		}
+		if data["email"] != "buyer@example.com" || data["code"] != "ABC12" {
+			t.Errorf("fitDataPayload() dropped more than needed: %v", data)
+		}
+		if size := dataPayloadSize(data); size > maxDataPayloadBytes {
+			t.Errorf("payload is %d bytes, want at most %d", size, maxDataPayloadBytes)
+		}
+	})
+
+	t.Run("truncates required values", func(t *testing.T) {
+		data := map[string]string{
+			"code":  "ABC12",
+			"title": strings.Repeat("é", maxDataPayloadBytes),
+		}
+		fitDataPayload(ctx, data, webhook)
+		if size := dataPayloadSize(data); size > maxDataPayloadBytes {
+			t.Errorf("payload is %d bytes, want at most %d", size, maxDataPayloadBytes)
+		}
+		if data["code"] != "ABC12" {
+			t.Errorf("code = %q, want it untouched", data["code"])
+		}
+		if !utf8.ValidString(data["title"]) {
+			t.Error("truncated title is not valid UTF-8")
+		}
+	})
+
+	t.Run("keys alone over limit", func(t *testing.T) {
+		data := map[string]string{
+			strings.Repeat("k", maxDataPayloadBytes): "v",
+			"code":                                   "ABC12",
+		}
+		fitDataPayload(ctx, data, webhook)
+		if _, ok := data[""]; ok {
+			t.Errorf("fitDataPayload() added an empty key: %v", data)
+		}
+		if len(data) != 2 {
+			t.Errorf("payload has %d keys, want 2", len(data))
+		}
+	})
+}
+
+func TestMethodNotAllowedAllowHeader(t *testing.T) {
+	loadTestConfig(t, map[string]string{"NOTIFIERS": "fcm"})
+	mux := http.NewServeMux()
+	registerRoutes(mux, "/api")
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodGet, "/api/webhook", "POST"},
+		{http.MethodPost, "/api/health", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/api/readyz", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/api/version", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/api/stats", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/api/replay", "OPTIONS, POST"},
+		{http.MethodGet, "/api/replay/42", "OPTIONS, POST"},
+		{http.MethodPost, "/api/config", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/api/events", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/api/test-fcm", "OPTIONS, POST"},
+		{http.MethodGet, "/api/test-fcm-bulk", "OPTIONS, POST"},
+		{http.MethodGet, "/api/admin/reload-credentials", "OPTIONS, POST"},
+		{http.MethodGet, "/api/register", "DELETE, OPTIONS, POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 10, "abc"},
+		{"abcdefghij", 10, "abcdefghij"},
+		{"abcdefghijklmnop", 10, "abcdefghij..."},
+		{"", 10, ""},
+		{"abc", 0, "..."},
+		{"héllo", 2, "h..."},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+// setupDryRun configures a dry-run FCM notifier so webhooks can be processed
+// without credentials.
+func setupDryRun(t *testing.T, env map[string]string) {
+	t.Helper()
+	env["DRY_RUN"] = "true"
+	env["NOTIFIERS"] = "fcm"
+	loadTestConfig(t, env)
+
+	saved := notifiers
+	t.Cleanup(func() { notifiers = saved })
+	var err error
+	if notifiers, err = newNotifiers(config.Notifiers); err != nil {
+		t.Fatal(err)
+	}
+
+	savedTokens := tokenStore
+	t.Cleanup(func() { tokenStore = savedTokens })
+	if tokenStore, err = newFileTokenStore(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := fcmReady.Load()
+	t.Cleanup(func() { fcmReady.Store(ready) })
+	fcmReady.Store(true)
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleWebhookGzip(t *testing.T) {
+	setupDryRun(t, map[string]string{"MAX_BODY_BYTES": "1024"})
+	payload := []byte(`{"notification_id":8001,"organizer":"gdg","event":"devfest","code":"ABC12","action":"pretix.event.order.placed"}`)
+
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"gzipped payload", gzipBytes(t, payload), http.StatusOK},
+		{"malformed gzip", []byte("not gzip at all"), http.StatusBadRequest},
+		{"decompresses past the limit", gzipBytes(t, bytes.Repeat([]byte(" "), 64<<10)), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handleWebhook(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookBatch(t *testing.T) {
+	setupDryRun(t, map[string]string{})
+	webhook := func(id int) string {
+		return fmt.Sprintf(`{"notification_id":%d,"organizer":"gdg","event":"devfest","code":"ABC12","action":"pretix.event.order.placed"}`, id)
+	}
+	tooMany := make([]string, maxBatchWebhooks+1)
+	for i := range tooMany {
+		tooMany[i] = webhook(8100 + i)
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		throttled bool
+		status    int
+	}{
+		{"all delivered", "[" + webhook(8201) + "," + webhook(8202) + "]", false, http.StatusOK},
+		{"one malformed", "[" + webhook(8203) + `,{"organizer":"gdg"}]`, false, http.StatusMultiStatus},
+		{"one throttled", "[" + webhook(8204) + `,{"organizer":"gdg"}]`, true, http.StatusTooManyRequests},
+		{"too many webhooks", "[" + strings.Join(tooMany, ",") + "]", false, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.throttled {
+				fcmThrottledUntil.Store(time.Now().Add(time.Minute).UnixNano())
+				defer fcmThrottledUntil.Store(0)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handleWebhook(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.throttled && rec.Header().Get("Retry-After") == "" {
+				t.Error("throttled batch has no Retry-After header")
+			}
+		})
+	}
+}
+
+func TestForwardBeforeFiltering(t *testing.T) {
+	var forwarded []string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var webhook PretixWebhook
+		json.NewDecoder(r.Body).Decode(&webhook)
+		forwarded = append(forwarded, webhook.Action)
+		if webhook.Organizer == "down" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer sink.Close()
+
+	setupDryRun(t, map[string]string{
+		"FORWARD_URL":         sink.URL,
+		"FORWARD_REQUIRED":    "true",
+		"FCM_ACTION_DENYLIST": "pretix.event.order.canceled",
+	})
+	// Only the forwarder posts for real; notifications stay dry runs until
+	// they are filtered out anyway.
+	config.DryRun = false
+	forwarder = newWebhookForwarder()
+	defer func() { forwarder = nil }()
+
+	tests := []struct {
+		name      string
+		organizer string
+		action    string
+		status    int
+	}{
+		{"filtered action", "gdg", "pretix.event.order.canceled", http.StatusOK},
+		{"test ping", "gdg", config.PretixTestAction, http.StatusOK},
+		{"required forward fails", "down", "pretix.event.order.canceled", http.StatusServiceUnavailable},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			body := fmt.Sprintf(`{"notification_id":%d,"organizer":%q,"event":"devfest","code":"ABC12","action":%q}`, 8301+i, tt.organizer, tt.action)
+			res := processWebhook(context.Background(), []byte(body), time.Now(), "192.0.2.1")
+			if res.status != tt.status {
+				t.Errorf("status = %d, want %d (%s)", res.status, tt.status, res.err)
+			}
+			if len(forwarded) != 1 || forwarded[0] != tt.action {
+				t.Errorf("forwarded %v, want [%s]", forwarded, tt.action)
+			}
+		})
+	}
+}
+
+func TestDeepLinkOnPlatforms(t *testing.T) {
+	loadTestConfig(t, map[string]string{
+		"FCM_ANDROID_CLICK_ACTION": "OPEN_ORDERS",
+		"FCM_DEEP_LINK":            "myapp://orders/{{.Event}}{{if .Code}}/{{.Code}}{{end}}",
+		"FCM_APNS_ENABLED":         "true",
+	})
+	webhook := PretixWebhook{Organizer: "gdg", Event: "devfest", Code: "ABC12", Action: "pretix.event.order.paid"}
+
+	link := deepLink(context.Background(), notificationContext{PretixWebhook: webhook})
+	if link != "myapp://orders/devfest/ABC12" {
+		t.Fatalf("deepLink() = %q", link)
+	}
+	if got := androidConfig(webhook, "", time.Hour, link).Notification.ClickAction; got != link {
+		t.Errorf("Android click action = %q, want %q", got, link)
+	}
+	if got := androidConfig(webhook, "", time.Hour, "").Notification.ClickAction; got != "OPEN_ORDERS" {
+		t.Errorf("Android click action without link = %q, want OPEN_ORDERS", got)
+	}
+	if got := apnsConfig("t", "b", nil, "", time.Hour, "", link).Payload.CustomData["deep_link"]; got != link {
+		t.Errorf("APNS deep_link = %v, want %q", got, link)
+	}
+}
+
+func TestNewPretixClientBaseURL(t *testing.T) {
+	for _, raw := range []string{
+		"https://pretix.eu",
+		"https://pretix.eu/",
+		"https://pretix.eu/api/v1",
+		"https://pretix.eu/api/v1/",
+	} {
+		if got := newPretixClient(raw, "", time.Second).baseURL; got != "https://pretix.eu" {
+			t.Errorf("newPretixClient(%q).baseURL = %q, want https://pretix.eu", raw, got)
+		}
+	}
+}
+
+func TestCollapseKey(t *testing.T) {
+	loadTestConfig(t, map[string]string{"FCM_COLLAPSE_KEY": "{{.Organizer}}-{{.Event}}"})
+
+	tests := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{"short", "devfest", "gdg-devfest"},
+		{"ascii over limit", strings.Repeat("a", 70), "gdg-" + strings.Repeat("a", 60)},
+		// "é" is two bytes; the one straddling the limit is dropped whole.
+		{"multi-byte over limit", strings.Repeat("é", 40), "gdg-" + strings.Repeat("é", 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := notificationContext{PretixWebhook: PretixWebhook{Organizer: "gdg", Event: tt.event}}
+			got := collapseKey(context.Background(), nc)
+			if got != tt.want {
+				t.Errorf("collapseKey() = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("collapseKey() = %q is not valid UTF-8", got)
+			}
+		})
+	}
+}
+
+func TestPlacedAndPaidRouting(t *testing.T) {
+	loadTestConfig(t, map[string]string{
+		"FCM_TOPIC":            "pretix-orders",
+		"FCM_ACTION_TOPICS":    `{"pretix.event.order.placed":"finance","pretix.event.order.paid":"finance,volunteers"}`,
+		"FCM_ACTION_TEMPLATES": `{"pretix.event.order.placed":{"title":"Reservation {{.Code}}","body":"Awaiting payment for {{.Event}}"},"pretix.event.order.paid":{"title":"Paid {{.Code}}"}}`,
+	})
+
+	tests := []struct {
+		action string
+		topics []string
+		title  string
+		body   string
+	}{
+		{"pretix.event.order.placed", []string{"finance"}, "Reservation ABC12", "Awaiting payment for devfest"},
+		// Only the title is overridden, so the built-in body is kept.
+		{"pretix.event.order.paid", []string{"finance", "volunteers"}, "Paid ABC12", "Order ABC12 from devfest"},
+		// Entries match whole action names, not prefixes.
+		{"pretix.event.order.placed.require_approval", []string{"pretix-orders"}, "⏳ Order awaiting approval", "Order ABC12 from devfest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			webhook := PretixWebhook{Organizer: "gdg", Event: "devfest", Code: "ABC12", Action: tt.action}
+			if got := resolveTopics(webhook); !slices.Equal(got, tt.topics) {
+				t.Errorf("resolveTopics() = %v, want %v", got, tt.topics)
+			}
+
+			nc := notificationContext{PretixWebhook: webhook, Type: webhookTypeOrder, ActionTitle: formatAction(tt.action)}
+			title, body := notificationText(context.Background(), nc, "en")
+			if title != tt.title || body != tt.body {
+				t.Errorf("notificationText() = %q, %q, want %q, %q", title, body, tt.title, tt.body)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base := 200 * time.Millisecond
+	if d := retryDelay(base, 1); d < base/2 || d > base {
+		t.Errorf("retryDelay(%s, 1) = %s, want between %s and %s", base, d, base/2, base)
+	}
+	// Large attempt counts used to shift the delay into overflow.
+	for _, attempt := range []int{10, 64, 1000} {
+		if d := retryDelay(base, attempt); d < maxRetryDelay/2 || d > maxRetryDelay {
+			t.Errorf("retryDelay(%s, %d) = %s, want between %s and %s", base, attempt, d, maxRetryDelay/2, maxRetryDelay)
+		}
+	}
+	if d := retryDelay(0, 3); d != 0 {
+		t.Errorf("retryDelay(0, 3) = %s, want 0", d)
+	}
+}
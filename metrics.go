@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhooksReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pretix_webhooks_received_total",
+		Help: "Number of Pretix webhooks received, by action.",
+	}, []string{"action"})
+
+	duplicateWebhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "duplicate_webhooks_total",
+		Help: "Number of webhooks skipped because their notification was already processed, by action.",
+	}, []string{"action"})
+
+	fcmSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fcm_sends_total",
+		Help: "Number of FCM send attempts, by result (success or failure).",
+	}, []string{"result"})
+
+	fcmQuotaExceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fcm_quota_exceeded_total",
+		Help: "Number of FCM sends rejected for exceeding the quota.",
+	})
+
+	fcmSendsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fcm_sends_in_flight",
+		Help: "Number of FCM sends currently in progress.",
+	})
+
+	fcmSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fcm_send_duration_seconds",
+		Help:    "Latency of FCM sends, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	webhookDeliveryLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_delivery_lag_seconds",
+		Help:    "Time from event creation in Pretix to the FCM send, for webhooks with a created timestamp, by action.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"action"})
+)
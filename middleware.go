@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+type requestIDKey struct{}
+
+// withRequestID assigns every request a correlation ID, reusing an incoming
+// X-Request-ID header when present. The ID is stored in the request context,
+// echoed back in the response header and added to every log line written
+// with that context.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(contextWithRequestID(r.Context(), id)))
+	})
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// recoverPanics turns a panicking handler into a 500 response with the stack
+// trace logged, instead of a reset connection. It must run inside
+// withRequestID so the log carries the request ID.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// ErrAbortHandler is how a handler deliberately aborts the
+			// response; the server handles it quietly.
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			slog.ErrorContext(r.Context(), "Recovered from panic in handler",
+				"method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessLog logs every request's method, path, status, size, duration and
+// client IP once it completes. It must run inside withRequestID so each line
+// carries the request ID.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		slog.InfoContext(r.Context(), "HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"client_ip", clientIP(r),
+		)
+	})
+}
+
+// statusRecorder remembers the status code and body size written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// contextHandler is a slog.Handler that adds the request ID from the context
+// to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// ipRateLimiter hands out a token bucket per client IP. Buckets that have
+// been idle for a while are dropped so the map doesn't grow without bound.
+type ipRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiterIdleTimeout is how long a client's bucket is kept after its last
+// request.
+const rateLimiterIdleTimeout = 3 * time.Minute
+
+func newIPRateLimiter(limit rate.Limit, burst int) *ipRateLimiter {
+	l := &ipRateLimiter{limit: limit, burst: burst, visitors: make(map[string]*visitor)}
+	go l.cleanup()
+	return l
+}
+
+func (l *ipRateLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, ok := l.visitors[ip]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.visitors[ip] = v
+	}
+	v.lastSeen = time.Now()
+	return v.limiter
+}
+
+func (l *ipRateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, v := range l.visitors {
+			if time.Since(v.lastSeen) > rateLimiterIdleTimeout {
+				delete(l.visitors, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimit rejects requests over RATE_LIMIT per client IP with 429 and a
+// Retry-After header. It is a no-op when rate limiting is disabled.
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		reservation := limiter.get(ip).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			slog.WarnContext(r.Context(), "Rate limit exceeded", "path", r.URL.Path, "client_ip", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// cors adds CORS headers for requests whose Origin is listed in
+// CORS_ALLOWED_ORIGINS ("*" allows any origin). Requests from other origins
+// are served without the headers, so browsers block the response.
+func cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && len(config.CORSAllowedOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+			if originAllowed(origin, config.CORSAllowedOrigins) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+func originAllowed(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePreflight answers CORS preflight requests. The allow headers are
+// only meaningful alongside the Access-Control-Allow-Origin set by cors.
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientIP returns the IP address of the client that sent r. Proxy headers
+// are only honored when TRUST_PROXY_HEADERS is set: X-Forwarded-For is read
+// TRUSTED_PROXY_COUNT entries from the right, since anything further left
+// was supplied by the client and can be spoofed. X-Real-IP is used when
+// X-Forwarded-For is absent.
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !config.TrustProxyHeaders {
+		return remote
+	}
+
+	if header := r.Header.Values("X-Forwarded-For"); len(header) > 0 {
+		var hops []string
+		for _, value := range header {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		i := max(len(hops)-config.TrustedProxyCount, 0)
+		if ip := net.ParseIP(hops[i]); ip != nil {
+			return ip.String()
+		}
+		return remote
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return remote
+}
+
+// requireAllowedIP rejects requests whose client IP isn't covered by
+// WEBHOOK_ALLOWED_IPS. An empty allowlist allows everyone.
+func requireAllowedIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config.WebhookAllowedIPs) == 0 {
+			next(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if !ipAllowed(net.ParseIP(ip), config.WebhookAllowedIPs) {
+			slog.WarnContext(r.Context(), "Rejected request from disallowed IP", "path", r.URL.Path, "client_ip", ip)
+			writeJSONError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func ipAllowed(ip net.IP, allowed []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a list of CIDRs, accepting bare IPs as single-address
+// networks.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notificationContext is the data available to notification templates. The
+// embedded PretixWebhook exposes fields like {{.Code}} and {{.Event}}.
+type notificationContext struct {
+	PretixWebhook
+	Type        string // webhook type: "order", "checkin" or "event"
+	BuyerName   string
+	Summary     string // enriched order summary, empty without the Pretix API
+	ActionTitle string // human readable action, e.g. "Paid"
+	TotalText   string // Total formatted with its currency, e.g. "€50.00"
+	RefundText  string // RefundAmount formatted with its currency
+
+	// Check-in details, empty without the Pretix API.
+	AttendeeName string
+	CheckinList  string
+	ScannedAt    time.Time
+}
+
+// textTemplates holds the title and body templates for one locale or action.
+// Either may be nil to keep the less specific template.
+type textTemplates struct {
+	Title *template.Template
+	Body  *template.Template
+}
+
+// parseTextTemplates parses FCM_LOCALES or FCM_ACTION_TEMPLATES, a JSON
+// object mapping locale codes or actions to {"title": ..., "body": ...}
+// template strings.
+func parseTextTemplates(raw string) (map[string]textTemplates, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var texts map[string]struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}
+	if err := json.Unmarshal([]byte(raw), &texts); err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]textTemplates, len(texts))
+	for key, text := range texts {
+		title, err := parseTemplate(key+".title", text.Title)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		body, err := parseTemplate(key+".body", text.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		templates[key] = textTemplates{Title: title, Body: body}
+	}
+	return templates, nil
+}
+
+// resolveLocale picks the notification locale for a webhook from
+// FCM_LOCALE_MAP, keyed by "organizer/event" or "organizer", falling back to
+// the default locale.
+func resolveLocale(webhook PretixWebhook) string {
+	if locale, ok := config.LocaleMapping[webhook.Organizer+"/"+webhook.Event]; ok {
+		return locale
+	}
+	if locale, ok := config.LocaleMapping[webhook.Organizer]; ok {
+		return locale
+	}
+	return config.DefaultLocale
+}
+
+// parseTemplate parses a notification template, returning nil when text is
+// empty. The template is executed once against empty data so references to
+// unknown fields are caught at startup rather than on the first webhook.
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, notificationContext{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// parseDeepLink parses a deep-link template like parseTemplate and checks
+// that it renders an absolute URL such as "myapp://orders/{{.Event}}/{{.Code}}".
+func parseDeepLink(name, text string) (*template.Template, error) {
+	tmpl, err := parseTemplate(name, text)
+	if err != nil || tmpl == nil {
+		return tmpl, err
+	}
+
+	var sb strings.Builder
+	sample := notificationContext{PretixWebhook: PretixWebhook{Organizer: "organizer", Event: "event", Code: "ABCDE"}}
+	if err := tmpl.Execute(&sb, sample); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(sb.String())
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("deep link must be an absolute URL: %q", sb.String())
+	}
+	return tmpl, nil
+}
+
+// deepLink renders the deep link for nc from FCM_ACTION_DEEP_LINKS or else
+// FCM_DEEP_LINK. An empty result means the notification has no link.
+func deepLink(ctx context.Context, nc notificationContext) string {
+	tmpl := config.DeepLink
+	if t, ok := lookupAction(config.ActionDeepLinks, nc.Action); ok {
+		tmpl = t
+	}
+	if tmpl == nil {
+		return ""
+	}
+	return renderTemplate(ctx, tmpl, nc, "")
+}
+
+// notificationText renders the title and body for a webhook. Templates for
+// the webhook's action take precedence over those for the given locale, then
+// the global templates, which in turn override the built-in format.
+func notificationText(ctx context.Context, nc notificationContext, locale string) (title, body string) {
+	title = defaultTitle(nc)
+	body = defaultBody(nc)
+
+	titleTmpl, bodyTmpl := config.TitleTemplate, config.BodyTemplate
+	if lt, ok := config.Locales[locale]; ok {
+		if lt.Title != nil {
+			titleTmpl = lt.Title
+		}
+		if lt.Body != nil {
+			bodyTmpl = lt.Body
+		}
+	}
+	if at, ok := lookupAction(config.ActionTemplates, nc.Action); ok {
+		if at.Title != nil {
+			titleTmpl = at.Title
+		}
+		if at.Body != nil {
+			bodyTmpl = at.Body
+		}
+	}
+
+	if titleTmpl != nil {
+		title = renderTemplate(ctx, titleTmpl, nc, title)
+	}
+	if bodyTmpl != nil {
+		body = renderTemplate(ctx, bodyTmpl, nc, body)
+	}
+	return title, body
+}
+
+// defaultActionTitles are the built-in friendly titles for known actions.
+// FCM_ACTION_TITLES entries override or extend them.
+var defaultActionTitles = map[string]string{
+	"pretix.event.order.placed":                  "🛒 New order",
+	"pretix.event.order.placed.require_approval": "⏳ Order awaiting approval",
+	"pretix.event.order.paid":                    "💰 Payment received",
+	"pretix.event.order.canceled":                "❌ Order canceled",
+	"pretix.event.order.expired":                 "⌛ Order expired",
+	"pretix.event.order.modified":                "✏️ Order modified",
+	"pretix.event.order.contact.changed":         "✏️ Order contact changed",
+	"pretix.event.order.changed.*":               "✏️ Order changed",
+	"pretix.event.order.approved":                "✅ Order approved",
+	"pretix.event.order.denied":                  "🚫 Order denied",
+	"pretix.event.order.refund.created":          "💸 Refund created",
+	"pretix.event.order.refund.done":             "💸 Refund completed",
+	"pretix.event.checkin":                       "🎟️ Attendee checked in",
+	"pretix.event.checkin.reverted":              "↩️ Check-in reverted",
+}
+
+// defaultTitle returns the friendly title for the webhook's action, falling
+// back to "Order <Action>" for actions without one.
+func defaultTitle(nc notificationContext) string {
+	if title, ok := lookupAction(config.ActionTitles, nc.Action); ok {
+		return title
+	}
+	if title, ok := lookupAction(defaultActionTitles, nc.Action); ok {
+		return title
+	}
+	if config.ActionTitleIncludeObject {
+		return nc.ActionTitle
+	}
+	switch nc.Type {
+	case webhookTypeCheckin:
+		return fmt.Sprintf("Check-in %s", nc.ActionTitle)
+	case webhookTypeEvent:
+		return fmt.Sprintf("Event %s", nc.ActionTitle)
+	case webhookTypeRefund:
+		// ActionTitle already reads e.g. "Refund Failed".
+		return nc.ActionTitle
+	}
+	return fmt.Sprintf("Order %s", nc.ActionTitle)
+}
+
+// lookupAction finds the value for action in a map keyed by exact actions or
+// trailing-wildcard patterns, preferring an exact match and then the longest
+// matching pattern.
+func lookupAction[V any](m map[string]V, action string) (V, bool) {
+	if value, ok := m[action]; ok {
+		return value, true
+	}
+
+	var best string
+	var value V
+	for pattern, v := range m {
+		if strings.HasSuffix(pattern, "*") && matchAction(pattern, action) && len(pattern) > len(best) {
+			best, value = pattern, v
+		}
+	}
+	return value, best != ""
+}
+
+func defaultBody(nc notificationContext) string {
+	switch nc.Type {
+	case webhookTypeCheckin:
+		attendee := nc.AttendeeName
+		if attendee == "" {
+			attendee = "Attendee"
+		}
+		body := fmt.Sprintf("%s checked in to %s", attendee, nc.Event)
+		if nc.CheckinList != "" {
+			body += fmt.Sprintf(" (%s)", nc.CheckinList)
+		}
+		if nc.Code != "" && nc.AttendeeName == "" {
+			body += fmt.Sprintf(" with order %s", nc.Code)
+		}
+		return body
+	case webhookTypeEvent:
+		return fmt.Sprintf("%s: %s", nc.Event, nc.ActionTitle)
+	case webhookTypeRefund:
+		return refundBody(nc)
+	}
+
+	body := fmt.Sprintf("Order %s from %s", nc.Code, nc.Event)
+	if nc.Summary != "" {
+		body = nc.Summary
+	} else if nc.Status != "" {
+		body += fmt.Sprintf(" - %s", nc.Status)
+	}
+	if nc.TotalText != "" {
+		body += fmt.Sprintf(" (Total: %s)", nc.TotalText)
+	} else if nc.Total != "" {
+		body += fmt.Sprintf(" (Total: %s)", nc.Total)
+	}
+	return body
+}
+
+// refundVerbs describe what happened to a refund, by action.
+var refundVerbs = map[string]string{
+	"pretix.event.order.refund.created":            "issued",
+	"pretix.event.order.refund.created.externally": "received externally",
+	"pretix.event.order.refund.requested":          "requested",
+	"pretix.event.order.refund.done":               "completed",
+	"pretix.event.order.refund.canceled":           "canceled",
+	"pretix.event.order.refund.failed":             "failed",
+}
+
+// refundBody renders e.g. "Refund of €20.00 issued for order ABCDE".
+func refundBody(nc notificationContext) string {
+	amount := nc.RefundText
+	if amount == "" {
+		amount = nc.RefundAmount
+	}
+
+	body := "Refund"
+	if amount != "" {
+		body += " of " + amount
+	}
+	if verb, ok := refundVerbs[nc.Action]; ok {
+		body += " " + verb
+	} else {
+		body += ": " + strings.ToLower(nc.ActionTitle)
+	}
+	body += fmt.Sprintf(" for order %s", nc.Code)
+	if nc.RefundReason != "" {
+		body += fmt.Sprintf(" (%s)", nc.RefundReason)
+	}
+	return body
+}
+
+// renderTemplate executes tmpl, falling back to fallback if execution fails
+// so a bad template never blocks a notification.
+func renderTemplate(ctx context.Context, tmpl *template.Template, nc notificationContext, fallback string) string {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, nc); err != nil {
+		slog.WarnContext(ctx, "Error rendering notification template",
+			append(webhookAttrs(nc.PretixWebhook), "template", tmpl.Name(), "error", err)...)
+		return fallback
+	}
+	return sb.String()
+}
+
+// maxCollapseKeyLength is the APNS limit on apns-collapse-id, applied to the
+// Android collapse key as well so both platforms group identically.
+const maxCollapseKeyLength = 64
+
+// collapseKey renders FCM_COLLAPSE_KEY for a notification. An empty result
+// disables collapsing.
+func collapseKey(ctx context.Context, nc notificationContext) string {
+	if config.CollapseKey == nil {
+		return ""
+	}
+	return truncateUTF8(renderTemplate(ctx, config.CollapseKey, nc, ""), maxCollapseKeyLength)
+}
+
+// FCM analytics labels are limited to 50 of these characters.
+var (
+	analyticsLabelPattern   = regexp.MustCompile(`^[a-zA-Z0-9\-_.~%]{1,50}$`)
+	analyticsLabelForbidden = regexp.MustCompile(`[^a-zA-Z0-9\-_.~%]`)
+)
+
+const maxAnalyticsLabelLength = 50
+
+// analyticsLabel returns the FCM analytics label for a notification: the
+// action's FCM_ACTION_ANALYTICS_LABELS entry, else FCM_ANALYTICS_LABEL
+// rendered and sanitized, since FCM rejects the whole message over an
+// invalid label. An empty result sends no label.
+func analyticsLabel(ctx context.Context, nc notificationContext) string {
+	if label, ok := lookupAction(config.ActionAnalyticsLabels, nc.Action); ok {
+		return label
+	}
+	if config.AnalyticsLabel == nil {
+		return ""
+	}
+
+	rendered := renderTemplate(ctx, config.AnalyticsLabel, nc, "")
+	label := analyticsLabelForbidden.ReplaceAllString(rendered, "_")
+	if len(label) > maxAnalyticsLabelLength {
+		label = label[:maxAnalyticsLabelLength]
+	}
+	if label != rendered {
+		slog.DebugContext(ctx, "Sanitized FCM analytics label",
+			append(webhookAttrs(nc.PretixWebhook), "rendered", rendered, "label", label)...)
+	}
+	return label
+}
+
+// aggregateText is the notification shown for several orders coalesced
+// within FCM_AGGREGATION_WINDOW.
+func aggregateText(webhooks []PretixWebhook) (title, body string) {
+	codes := make([]string, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		if webhook.Code != "" {
+			codes = append(codes, webhook.Code)
+		}
+	}
+
+	title = fmt.Sprintf("🎫 %d new orders", len(webhooks))
+	body = fmt.Sprintf("%d new orders for %s", len(webhooks), webhooks[0].Event)
+	if len(codes) > 0 {
+		body += fmt.Sprintf(": %s", strings.Join(codes, ", "))
+	}
+	return title, body
+}
+
+// cooldownText summarizes the webhooks suppressed during an event's
+// cooldown, e.g. "+12 more orders".
+func cooldownText(webhooks []PretixWebhook) (title, body string) {
+	noun := "notifications"
+	if webhookType(webhooks[0].Action) == webhookTypeOrder {
+		noun = "orders"
+	}
+	title = fmt.Sprintf("🎫 +%d more %s", len(webhooks), noun)
+	body = fmt.Sprintf("%d more %s for %s since the last notification", len(webhooks), noun, webhooks[0].Event)
+	return title, body
+}
+
+// testMessages are the default /test-fcm strings per locale.
+var testMessages = map[string]struct{ Title, Body string }{
+	"en": {"Test FCM Message", "This is a test message from your webhook service"},
+	"id": {"Pesan Uji FCM", "Ini adalah pesan uji dari layanan webhook Anda"},
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"firebase.google.com/go/v4/messaging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Notification backends, enabled with NOTIFIERS.
+const (
+	notifierFCM   = "fcm"
+	notifierSlack = "slack"
+	notifierEmail = "email"
+)
+
+// Event is a rendered notification, handed to every enabled Notifier.
+type Event struct {
+	Webhook     PretixWebhook
+	Type        string
+	Title       string
+	Body        string
+	CollapseKey string
+	// Batch holds the webhooks combined into an aggregated event.
+	Batch []PretixWebhook
+	// Data holds the notification fields sent as the FCM data payload.
+	// Notifiers must not modify it.
+	Data map[string]string
+	// AnalyticsLabel tags the FCM message in Firebase analytics, if set.
+	AnalyticsLabel string
+	// DeepLink is opened when the notification is tapped, if set.
+	DeepLink string
+}
+
+// Notifier delivers events to one notification backend.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event Event) error
+}
+
+// notifiers are the enabled backends, in NOTIFIERS order.
+var notifiers []Notifier
+
+func newNotifiers(names []string) ([]Notifier, error) {
+	var result []Notifier
+	for _, name := range names {
+		switch name {
+		case notifierFCM:
+			result = append(result, fcmNotifier{})
+		case notifierSlack:
+			if config.SlackWebhookURL == "" {
+				return nil, fmt.Errorf("SLACK_WEBHOOK_URL is required for the %s notifier", name)
+			}
+			result = append(result, newSlackNotifier(config.SlackWebhookURL, config.SlackTimeout))
+		case notifierEmail:
+			if config.SMTPHost == "" || config.SMTPFrom == "" || len(config.SMTPTo) == 0 {
+				return nil, fmt.Errorf("SMTP_HOST, SMTP_FROM and SMTP_TO are required for the %s notifier", name)
+			}
+			result = append(result, newEmailNotifier())
+		default:
+			return nil, fmt.Errorf("unknown notifier %q", name)
+		}
+	}
+	return result, nil
+}
+
+func notifierEnabled(name string) bool {
+	return slices.Contains(config.Notifiers, name)
+}
+
+// primaryNotifier returns the index of the notifier whose result decides
+// whether a webhook was delivered: FCM when enabled, otherwise the first in
+// NOTIFIERS.
+func primaryNotifier() int {
+	for i, n := range notifiers {
+		if n.Name() == notifierFCM {
+			return i
+		}
+	}
+	return 0
+}
+
+// notify sends event through every notifier concurrently. A failing backend
+// doesn't stop the others. Only the primary notifier's error fails the
+// webhook; the rest are logged so a Slack outage doesn't make Pretix retry an
+// already delivered push.
+func notify(ctx context.Context, event Event) error {
+	setStage(ctx, "send")
+	// Don't start sends once the webhook's deadline has passed, e.g. after
+	// slow enrichment.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	primary := primaryNotifier()
+	var primaryErr error
+	var wg sync.WaitGroup
+	for i, n := range notifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := n.Notify(ctx, event)
+			if err == nil {
+				return
+			}
+			if i == primary {
+				primaryErr = fmt.Errorf("%s: %w", n.Name(), err)
+				return
+			}
+			slog.ErrorContext(ctx, "Error sending notification", append(webhookAttrs(event.Webhook), "notifier", n.Name(), "error", err)...)
+		}()
+	}
+	wg.Wait()
+	return primaryErr
+}
+
+// fcmNotifier sends events as FCM messages to the configured topics and
+// device tokens.
+type fcmNotifier struct{}
+
+func (fcmNotifier) Name() string {
+	return notifierFCM
+}
+
+func (fcmNotifier) Notify(ctx context.Context, event Event) (err error) {
+	webhook := event.Webhook
+	ctx, span := tracer.Start(ctx, "fcm notify", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(webhookSpanAttrs(webhook)...))
+	defer func() { endSpan(span, err) }()
+	data := withStaticData(event.Data)
+	fitDataPayload(ctx, data, webhook)
+
+	ttl := messageTTL(webhook.Action)
+	message := messaging.Message{
+		Notification: &messaging.Notification{
+			Title: event.Title,
+			Body:  event.Body,
+		},
+		Data:    data,
+		Android: androidConfig(webhook, event.CollapseKey, ttl, event.DeepLink),
+		APNS:    apnsConfig(event.Title, event.Body, data, event.CollapseKey, ttl, notificationSound(webhook, config.APNSSound), event.DeepLink),
+	}
+	if event.AnalyticsLabel != "" {
+		message.FCMOptions = &messaging.FCMOptions{AnalyticsLabel: event.AnalyticsLabel}
+	}
+	applyImage(&message, notificationImage(webhook))
+	if isDataOnly(webhook.Action) {
+		makeDataOnly(&message)
+	}
+
+	return sendToRecipients(ctx, message, webhook)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pretixClient is a minimal client for the Pretix REST API, used to enrich
+// notifications with order details the webhook payload doesn't carry.
+type pretixClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+
+	mu         sync.Mutex
+	itemNames  map[string]string
+	currencies map[string]string
+	listNames  map[string]string
+}
+
+type pretixOrder struct {
+	Code           string `json:"code"`
+	Status         string `json:"status"`
+	Email          string `json:"email"`
+	Total          string `json:"total"`
+	InvoiceAddress struct {
+		Name string `json:"name"`
+	} `json:"invoice_address"`
+	Positions []struct {
+		Item         int    `json:"item"`
+		AttendeeName string `json:"attendee_name"`
+		Checkins     []struct {
+			List     int       `json:"list"`
+			Datetime time.Time `json:"datetime"`
+		} `json:"checkins"`
+	} `json:"positions"`
+}
+
+type pretixCheckinList struct {
+	Name string `json:"name"`
+}
+
+// checkinDetails describes the most recent check-in of an order.
+type checkinDetails struct {
+	AttendeeName string
+	ListName     string
+	ScannedAt    time.Time
+}
+
+type pretixRefund struct {
+	LocalID int    `json:"local_id"`
+	Amount  string `json:"amount"`
+	Comment string `json:"comment"`
+}
+
+// refundDetails describes one refund of an order.
+type refundDetails struct {
+	ID       int
+	Amount   string
+	Reason   string
+	Currency string
+}
+
+type pretixEvent struct {
+	Currency string `json:"currency"`
+}
+
+type pretixItem struct {
+	ID   int               `json:"id"`
+	Name map[string]string `json:"name"`
+}
+
+// orderDetails is the enrichment data extracted from a Pretix order.
+type orderDetails struct {
+	BuyerName string
+	Items     []itemCount
+	Total     string
+	Currency  string
+	Status    string
+	Email     string
+}
+
+type itemCount struct {
+	Name  string
+	Count int
+}
+
+// newPretixClient creates a client for the Pretix instance at baseURL. The
+// API prefix is added per request, so a baseURL copied with "/api/v1" is
+// trimmed.
+func newPretixClient(baseURL, token string, timeout time.Duration) *pretixClient {
+	baseURL = strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/api/v1")
+	return &pretixClient{
+		baseURL:    baseURL,
+		token:      token,
+		httpClient: &http.Client{Timeout: timeout},
+		itemNames:  make(map[string]string),
+		currencies: make(map[string]string),
+		listNames:  make(map[string]string),
+	}
+}
+
+// fetchOrderDetails loads the order and resolves its item names.
+func (c *pretixClient) fetchOrderDetails(ctx context.Context, organizer, event, code string) (*orderDetails, error) {
+	var order pretixOrder
+	path := fmt.Sprintf("/api/v1/organizers/%s/events/%s/orders/%s/",
+		url.PathEscape(organizer), url.PathEscape(event), url.PathEscape(code))
+	if err := c.get(ctx, path, &order); err != nil {
+		return nil, fmt.Errorf("error fetching order: %v", err)
+	}
+
+	details := &orderDetails{
+		BuyerName: order.InvoiceAddress.Name,
+		Total:     order.Total,
+		Status:    order.Status,
+		Email:     order.Email,
+	}
+
+	counts := make(map[int]int)
+	var itemIDs []int
+	for _, position := range order.Positions {
+		if details.BuyerName == "" {
+			details.BuyerName = position.AttendeeName
+		}
+		if counts[position.Item] == 0 {
+			itemIDs = append(itemIDs, position.Item)
+		}
+		counts[position.Item]++
+	}
+
+	for _, id := range itemIDs {
+		name, err := c.itemName(ctx, organizer, event, id)
+		if err != nil {
+			return nil, err
+		}
+		details.Items = append(details.Items, itemCount{Name: name, Count: counts[id]})
+	}
+
+	// The currency only formats the total, so failing to look it up leaves
+	// it to FCM_CURRENCY rather than discarding the order details.
+	currency, err := c.eventCurrency(ctx, organizer, event)
+	if err != nil {
+		slog.WarnContext(ctx, "Error fetching event currency from Pretix API", "organizer", organizer, "event", event, "error", err)
+	}
+	details.Currency = currency
+
+	return details, nil
+}
+
+// fetchCheckinDetails loads the order and returns its latest check-in. The
+// webhook only carries the order code, so the attendee and list come from
+// the API.
+func (c *pretixClient) fetchCheckinDetails(ctx context.Context, organizer, event, code string) (*checkinDetails, error) {
+	var order pretixOrder
+	path := fmt.Sprintf("/api/v1/organizers/%s/events/%s/orders/%s/",
+		url.PathEscape(organizer), url.PathEscape(event), url.PathEscape(code))
+	if err := c.get(ctx, path, &order); err != nil {
+		return nil, fmt.Errorf("error fetching order: %v", err)
+	}
+
+	details := &checkinDetails{}
+	listID := 0
+	for _, position := range order.Positions {
+		for _, checkin := range position.Checkins {
+			if checkin.Datetime.After(details.ScannedAt) {
+				details.ScannedAt = checkin.Datetime
+				details.AttendeeName = position.AttendeeName
+				listID = checkin.List
+			}
+		}
+	}
+	if details.AttendeeName == "" {
+		details.AttendeeName = order.InvoiceAddress.Name
+	}
+
+	if listID != 0 {
+		name, err := c.checkinListName(ctx, organizer, event, listID)
+		if err != nil {
+			return nil, err
+		}
+		details.ListName = name
+	}
+	return details, nil
+}
+
+// fetchRefundDetails loads refund id of an order, or its most recent refund
+// when id is 0, reading every page of the order's refunds.
+func (c *pretixClient) fetchRefundDetails(ctx context.Context, organizer, event, code string, id int) (*refundDetails, error) {
+	base := fmt.Sprintf("/api/v1/organizers/%s/events/%s/orders/%s/refunds/",
+		url.PathEscape(organizer), url.PathEscape(event), url.PathEscape(code))
+
+	var refund pretixRefund
+	if id != 0 {
+		if err := c.get(ctx, fmt.Sprintf("%s%d/", base, id), &refund); err != nil {
+			return nil, fmt.Errorf("error fetching refund %d: %v", id, err)
+		}
+	} else {
+		for path := base; path != ""; {
+			var page struct {
+				Next    string         `json:"next"`
+				Results []pretixRefund `json:"results"`
+			}
+			if err := c.get(ctx, path, &page); err != nil {
+				return nil, fmt.Errorf("error fetching refunds: %v", err)
+			}
+			for _, r := range page.Results {
+				if r.LocalID > refund.LocalID {
+					refund = r
+				}
+			}
+
+			var err error
+			if path, err = c.nextPage(page.Next); err != nil {
+				return nil, err
+			}
+		}
+		if refund.LocalID == 0 {
+			return nil, fmt.Errorf("order %s has no refunds", code)
+		}
+	}
+
+	// Like for orders, a missing currency falls back to FCM_CURRENCY.
+	currency, err := c.eventCurrency(ctx, organizer, event)
+	if err != nil {
+		slog.WarnContext(ctx, "Error fetching event currency from Pretix API", "organizer", organizer, "event", event, "error", err)
+	}
+
+	return &refundDetails{
+		ID:       refund.LocalID,
+		Amount:   refund.Amount,
+		Reason:   refund.Comment,
+		Currency: currency,
+	}, nil
+}
+
+// nextPage turns the absolute next URL of a paginated response into a path
+// for get. URLs outside the API are refused so the token isn't sent
+// elsewhere.
+func (c *pretixClient) nextPage(next string) (string, error) {
+	if next == "" {
+		return "", nil
+	}
+	path, ok := strings.CutPrefix(next, c.baseURL+"/")
+	if !ok {
+		return "", fmt.Errorf("unexpected next page URL %q", next)
+	}
+	return "/" + path, nil
+}
+
+// checkinListName returns the name of a check-in list, cached like item
+// names.
+func (c *pretixClient) checkinListName(ctx context.Context, organizer, event string, id int) (string, error) {
+	key := fmt.Sprintf("%s/%s/%d", organizer, event, id)
+
+	c.mu.Lock()
+	name, ok := c.listNames[key]
+	c.mu.Unlock()
+	if ok {
+		return name, nil
+	}
+
+	var list pretixCheckinList
+	path := fmt.Sprintf("/api/v1/organizers/%s/events/%s/checkinlists/%d/",
+		url.PathEscape(organizer), url.PathEscape(event), id)
+	if err := c.get(ctx, path, &list); err != nil {
+		return "", fmt.Errorf("error fetching check-in list %d: %v", id, err)
+	}
+
+	c.mu.Lock()
+	c.listNames[key] = list.Name
+	c.mu.Unlock()
+
+	return list.Name, nil
+}
+
+// itemName returns the display name of an item, caching lookups since item
+// names rarely change.
+func (c *pretixClient) itemName(ctx context.Context, organizer, event string, id int) (string, error) {
+	key := fmt.Sprintf("%s/%s/%d", organizer, event, id)
+
+	c.mu.Lock()
+	name, ok := c.itemNames[key]
+	c.mu.Unlock()
+	if ok {
+		return name, nil
+	}
+
+	var item pretixItem
+	path := fmt.Sprintf("/api/v1/organizers/%s/events/%s/items/%d/",
+		url.PathEscape(organizer), url.PathEscape(event), id)
+	if err := c.get(ctx, path, &item); err != nil {
+		return "", fmt.Errorf("error fetching item %d: %v", id, err)
+	}
+
+	name = localizedString(item.Name)
+	c.mu.Lock()
+	c.itemNames[key] = name
+	c.mu.Unlock()
+
+	return name, nil
+}
+
+// eventCurrency returns the ISO currency code of an event, cached like item
+// names.
+func (c *pretixClient) eventCurrency(ctx context.Context, organizer, event string) (string, error) {
+	key := organizer + "/" + event
+
+	c.mu.Lock()
+	currency, ok := c.currencies[key]
+	c.mu.Unlock()
+	if ok {
+		return currency, nil
+	}
+
+	var e pretixEvent
+	path := fmt.Sprintf("/api/v1/organizers/%s/events/%s/", url.PathEscape(organizer), url.PathEscape(event))
+	if err := c.get(ctx, path, &e); err != nil {
+		return "", fmt.Errorf("error fetching event: %v", err)
+	}
+
+	c.mu.Lock()
+	c.currencies[key] = e.Currency
+	c.mu.Unlock()
+
+	return e.Currency, nil
+}
+
+func (c *pretixClient) get(ctx context.Context, path string, v any) error {
+	setStage(ctx, "enrich")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, path)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// localizedString picks a display value from a Pretix i18n string map,
+// preferring English.
+func localizedString(values map[string]string) string {
+	if name, ok := values["en"]; ok {
+		return name
+	}
+	for _, name := range values {
+		return name
+	}
+	return ""
+}
+
+// summary renders the order as e.g. "John Doe ordered 2× Conference Ticket".
+func (d *orderDetails) summary() string {
+	items := make([]string, 0, len(d.Items))
+	for _, item := range d.Items {
+		items = append(items, fmt.Sprintf("%d× %s", item.Count, item.Name))
+	}
+
+	buyer := d.BuyerName
+	if buyer == "" {
+		buyer = "Someone"
+	}
+	if len(items) == 0 {
+		return buyer + " placed an order"
+	}
+	return buyer + " ordered " + strings.Join(items, ", ")
+}
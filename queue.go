@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// webhookJob is a parsed webhook waiting to be delivered by a worker.
+type webhookJob struct {
+	webhook   PretixWebhook
+	recordID  int64
+	requestID string
+	// trace carries the trace context so delivery continues the request's
+	// trace.
+	trace map[string]string
+}
+
+// WebhookQueue delivers webhooks asynchronously through a pool of workers.
+type WebhookQueue interface {
+	// Enqueue adds a job without blocking. It returns false when the job
+	// can't be accepted so the caller can apply backpressure.
+	Enqueue(ctx context.Context, job webhookJob) bool
+	// Pending returns the number of jobs waiting for a worker.
+	Pending() int
+	// Close stops accepting jobs and waits for the workers to finish.
+	Close()
+	// Done is closed when Close is called, so workers waiting to requeue a
+	// job can give up.
+	Done() <-chan struct{}
+}
+
+// webhookQueue is an in-memory WebhookQueue draining a buffered channel.
+type webhookQueue struct {
+	jobs    chan webhookJob
+	done    chan struct{}
+	workers sync.WaitGroup
+
+	// mu guards closed so Enqueue never sends on the closed jobs channel.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newWebhookQueue(workers, size int) *webhookQueue {
+	q := &webhookQueue{jobs: make(chan webhookJob, size), done: make(chan struct{})}
+
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.run()
+	}
+
+	return q
+}
+
+// Enqueue returns false when the queue is full or closed.
+func (q *webhookQueue) Enqueue(ctx context.Context, job webhookJob) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *webhookQueue) Pending() int {
+	return len(q.jobs)
+}
+
+// Close waits until every queued job is processed.
+func (q *webhookQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	q.workers.Wait()
+}
+
+func (q *webhookQueue) Done() <-chan struct{} {
+	return q.done
+}
+
+func (q *webhookQueue) run() {
+	defer q.workers.Done()
+
+	for job := range q.jobs {
+		ctx := extractTrace(contextWithRequestID(context.Background(), job.requestID), job.trace)
+		deliverWebhook(ctx, job.webhook, job.recordID)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heldWebhook is a webhook waiting for quiet hours to end.
+type heldWebhook struct {
+	webhook  PretixWebhook
+	recordID int64
+}
+
+// quietHours suppresses notifications during a daily window such as
+// 22:00-07:00 in the TZ time zone. Webhooks arriving in the window are either
+// dropped or, with hold set, delivered when it ends.
+type quietHours struct {
+	start, end int // minutes after local midnight
+	loc        *time.Location
+	hold       bool
+
+	mu    sync.Mutex
+	held  []heldWebhook
+	timer *time.Timer
+}
+
+// quiet is set when QUIET_HOURS is configured.
+var quiet *quietHours
+
+// newQuietHours parses a "HH:MM-HH:MM" window. A start after the end spans
+// midnight.
+func newQuietHours(spec string, hold bool) (*quietHours, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, errors.New("start and end must differ")
+	}
+
+	// time.Local silently falls back to UTC for an unknown TZ, so load it
+	// explicitly to catch typos.
+	loc := time.Local
+	if tz := os.Getenv("TZ"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid TZ: %v", err)
+		}
+	}
+
+	return &quietHours{start: start, end: end, loc: loc, hold: hold}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether now falls within quiet hours.
+func (q *quietHours) active(now time.Time) bool {
+	t := now.In(q.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// endsAt returns the next end of quiet hours after now.
+func (q *quietHours) endsAt(now time.Time) time.Time {
+	t := now.In(q.loc)
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, q.loc)
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, q.end/60, q.end%60, 0, 0, q.loc)
+	}
+	return end
+}
+
+// suppress holds or drops the webhook during quiet hours. It returns false
+// when the caller should deliver the webhook itself.
+func (q *quietHours) suppress(ctx context.Context, webhook PretixWebhook, recordID int64) bool {
+	now := time.Now()
+	if !q.active(now) {
+		return false
+	}
+
+	if !q.hold {
+		slog.InfoContext(ctx, "Suppressing notification during quiet hours", webhookAttrs(webhook)...)
+		recordSendResult(ctx, recordID, sendStatusSuppressed, nil)
+		markProcessed(ctx, webhook)
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.held = append(q.held, heldWebhook{webhook: webhook, recordID: recordID})
+	if q.timer == nil {
+		q.timer = time.AfterFunc(time.Until(q.endsAt(now)), q.release)
+	}
+	slog.InfoContext(ctx, "Holding notification until quiet hours end",
+		append(webhookAttrs(webhook), "until", q.endsAt(now).Format(time.RFC3339), "pending", len(q.held))...)
+	return true
+}
+
+// release delivers the webhooks held during quiet hours.
+func (q *quietHours) release() {
+	q.mu.Lock()
+	held := q.held
+	q.held, q.timer = nil, nil
+	q.mu.Unlock()
+
+	ctx := context.Background()
+	if len(held) > 0 {
+		slog.InfoContext(ctx, "Quiet hours ended, delivering held notifications", "count", len(held))
+	}
+	for _, h := range held {
+		deliverWebhook(ctx, h.webhook, h.recordID)
+	}
+}
+
+// close stops the release timer on shutdown. Held webhooks are dead-lettered
+// rather than sent so a restart during the night doesn't wake anyone; they
+// can be replayed through /replay.
+func (q *quietHours) close() {
+	q.mu.Lock()
+	held := q.held
+	q.held = nil
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+
+	if len(held) == 0 {
+		return
+	}
+	ctx := context.Background()
+	if config.DeadLetterPath == "" {
+		slog.WarnContext(ctx, "Dropping notifications held for quiet hours, DEADLETTER_PATH is not set", "count", len(held))
+	}
+	err := errors.New("held for quiet hours at shutdown")
+	for _, h := range held {
+		recordSendResult(ctx, h.recordID, sendStatusFailed, err)
+		writeDeadLetter(ctx, h.webhook, err)
+	}
+}
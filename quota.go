@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"firebase.google.com/go/v4/errorutils"
+	"firebase.google.com/go/v4/messaging"
+)
+
+// fcmThrottledUntil is the Unix time in nanoseconds until which FCM sends are
+// suspended after a quota error, so every sender backs off together.
+var fcmThrottledUntil atomic.Int64
+
+// fcmQuotaError is returned for sends rejected by FCM for exceeding the quota
+// and for sends skipped while backing off.
+type fcmQuotaError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *fcmQuotaError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("FCM quota exceeded, backing off for %s", e.retryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("FCM quota exceeded, backing off for %s: %v", e.retryAfter.Round(time.Second), e.err)
+}
+
+func (e *fcmQuotaError) Unwrap() error {
+	return e.err
+}
+
+func isFCMQuotaError(err error) bool {
+	return messaging.IsQuotaExceeded(err) || errorutils.IsResourceExhausted(err)
+}
+
+// fcmRetryAfter returns how long FCM sends are still suspended, or 0.
+func fcmRetryAfter() time.Duration {
+	return max(time.Until(time.Unix(0, fcmThrottledUntil.Load())), 0)
+}
+
+// throttleFCM suspends FCM sends for the Retry-After FCM sent with err, or
+// FCM_QUOTA_BACKOFF without one, and returns the error to report.
+func throttleFCM(ctx context.Context, err error) *fcmQuotaError {
+	backoff := config.FCMQuotaBackoff
+	if resp := errorutils.HTTPResponse(err); resp != nil {
+		if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+			backoff = time.Duration(seconds) * time.Second
+		}
+	}
+
+	until := time.Now().Add(backoff).UnixNano()
+	for {
+		current := fcmThrottledUntil.Load()
+		if current >= until || fcmThrottledUntil.CompareAndSwap(current, until) {
+			break
+		}
+	}
+
+	fcmQuotaExceeded.Inc()
+	slog.WarnContext(ctx, "FCM quota exceeded, suspending sends", "backoff", backoff.String(), "error", err)
+	return &fcmQuotaError{retryAfter: backoff, err: err}
+}
+
+// writeThrottled answers a webhook with 429 and a Retry-After header while
+// FCM sends are suspended, so Pretix retries once the quota recovers.
+func writeThrottled(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	writeJSONError(w, http.StatusTooManyRequests, "FCM quota exceeded, retry later")
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up.
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// requeueAfterQuota waits out the FCM backoff and puts a queued webhook back
+// on the queue. It reports false when the webhook couldn't be requeued,
+// including when the queue shuts down during the wait.
+func requeueAfterQuota(ctx context.Context, webhook PretixWebhook, recordID int64) bool {
+	if queue == nil || !config.FCMQuotaRequeue {
+		return false
+	}
+
+	delay := fcmRetryAfter()
+	slog.InfoContext(ctx, "Requeueing webhook after FCM quota backoff", append(webhookAttrs(webhook), "delay", delay.String())...)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	case <-queue.Done():
+		slog.WarnContext(ctx, "Shutting down, not requeueing webhook", webhookAttrs(webhook)...)
+		return false
+	}
+	return queue.Enqueue(ctx, webhookJob{webhook: webhook, recordID: recordID, requestID: requestIDFrom(ctx), trace: injectTrace(ctx)})
+}
+
+// asFCMQuotaError returns the quota error in err's chain, if any.
+func asFCMQuotaError(err error) (*fcmQuotaError, bool) {
+	var quotaErr *fcmQuotaError
+	ok := errors.As(err, &quotaErr)
+	return quotaErr, ok
+}
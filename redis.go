@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys are namespaced so the instance can be shared with other
+// services.
+const (
+	redisProcessedKeyPrefix = "pretix-webhook:processed:"
+	redisQueueKey           = "pretix-webhook:queue"
+	redisProcessingKey      = "pretix-webhook:processing"
+)
+
+// redisClaimTTL bounds how long a claimed but undelivered notification blocks
+// redeliveries, so an instance crashing mid-send doesn't suppress Pretix's
+// retry for the whole DEDUP_TTL.
+const redisClaimTTL = 5 * time.Minute
+
+// redisClaimValue marks a notification claimed but not yet delivered.
+const redisClaimValue = "pending"
+
+// redisTimeout bounds individual Redis commands issued from request
+// handlers.
+const redisTimeout = 2 * time.Second
+
+// redisClient is set when REDIS_URL is configured.
+var redisClient *redis.Client
+
+func newRedisClient(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing REDIS_URL: %v", err)
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to Redis: %v", err)
+	}
+	return client, nil
+}
+
+// redisDedupStore is a DedupStore shared by every instance using the same
+// Redis, with expiry handled by Redis key TTLs.
+type redisDedupStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisDedupStore(client *redis.Client, ttl time.Duration) *redisDedupStore {
+	return &redisDedupStore{client: client, ttl: ttl}
+}
+
+// Seen doesn't count claims, whose webhooks may still fail.
+func (s *redisDedupStore) Seen(ctx context.Context, notificationID int64) (bool, error) {
+	value, err := s.client.Get(ctx, redisProcessedKeyPrefix+strconv.FormatInt(notificationID, 10)).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking processed notification: %v", err)
+	}
+	return value != redisClaimValue, nil
+}
+
+// Claim sets the notification's key with SET NX, so exactly one instance
+// wins.
+func (s *redisDedupStore) Claim(ctx context.Context, notificationID int64) (bool, error) {
+	key := redisProcessedKeyPrefix + strconv.FormatInt(notificationID, 10)
+	claimed, err := s.client.SetNX(ctx, key, redisClaimValue, min(s.ttl, redisClaimTTL)).Result()
+	if err != nil {
+		return false, fmt.Errorf("error claiming notification: %v", err)
+	}
+	return claimed, nil
+}
+
+// Release deletes the key only while it still holds the claim, leaving
+// notifications delivered in the meantime marked processed.
+func (s *redisDedupStore) Release(ctx context.Context, notificationID int64) error {
+	key := redisProcessedKeyPrefix + strconv.FormatInt(notificationID, 10)
+	if err := redisReleaseScript.Run(ctx, s.client, []string{key}, redisClaimValue).Err(); err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("error releasing notification claim: %v", err)
+	}
+	return nil
+}
+
+var redisReleaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func (s *redisDedupStore) MarkProcessed(ctx context.Context, notificationID int64) error {
+	key := redisProcessedKeyPrefix + strconv.FormatInt(notificationID, 10)
+	if err := s.client.Set(ctx, key, time.Now().UTC().Format(time.RFC3339), s.ttl).Err(); err != nil {
+		return fmt.Errorf("error marking notification processed: %v", err)
+	}
+	return nil
+}
+
+// Close is a no-op; the client is shared and closed in main.
+func (s *redisDedupStore) Close() error {
+	return nil
+}
+
+// redisJob is the JSON form of a webhookJob stored in the Redis list.
+// RawBody is carried separately because PretixWebhook doesn't serialize it.
+// The record ID belongs to the enqueuing host's DB_PATH store, so it is only
+// used when that host delivers the job.
+type redisJob struct {
+	Webhook   PretixWebhook     `json:"webhook"`
+	RawBody   []byte            `json:"raw_body,omitempty"`
+	RecordID  int64             `json:"record_id,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Trace     map[string]string `json:"trace,omitempty"`
+}
+
+// redisQueue is a WebhookQueue backed by a Redis list, so queued webhooks
+// survive restarts and can be drained by several instances. Workers move
+// each job to a processing list with BLMOVE and remove it once delivered, so
+// a job in flight when an instance dies isn't lost.
+type redisQueue struct {
+	client *redis.Client
+	size   int
+	host   string
+
+	stop    context.CancelFunc
+	stopCtx context.Context
+	workers sync.WaitGroup
+}
+
+func newRedisQueue(client *redis.Client, workers, size int) *redisQueue {
+	stopCtx, stop := context.WithCancel(context.Background())
+	q := &redisQueue{client: client, size: size, stop: stop, stopCtx: stopCtx}
+	q.host, _ = os.Hostname()
+	q.recover()
+
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.run()
+	}
+	return q
+}
+
+// Enqueue returns false when the list already holds QUEUE_SIZE jobs or Redis
+// is unavailable.
+func (q *redisQueue) Enqueue(ctx context.Context, job webhookJob) bool {
+	data, err := json.Marshal(redisJob{
+		Webhook:   job.webhook,
+		RawBody:   job.webhook.RawBody,
+		RecordID:  job.recordID,
+		Host:      q.host,
+		RequestID: job.requestID,
+		Trace:     job.trace,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding queued webhook", append(webhookAttrs(job.webhook), "error", err)...)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	if n, err := q.client.LLen(ctx, redisQueueKey).Result(); err != nil || n >= int64(q.size) {
+		if err != nil {
+			slog.ErrorContext(ctx, "Error checking Redis queue length", "error", err)
+		}
+		return false
+	}
+	if err := q.client.LPush(ctx, redisQueueKey, data).Err(); err != nil {
+		slog.ErrorContext(ctx, "Error pushing webhook to Redis queue", append(webhookAttrs(job.webhook), "error", err)...)
+		return false
+	}
+	return true
+}
+
+func (q *redisQueue) Pending() int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	n, err := q.client.LLen(ctx, redisQueueKey).Result()
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// recover moves jobs left in the processing list by a previous run back onto
+// the queue. Instances sharing Redis should be restarted one at a time, as a
+// starting instance also requeues jobs the others are delivering. Workers
+// skip those once they are marked processed, but one still being sent when
+// it is picked up again is sent twice.
+func (q *redisQueue) recover() {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	recovered := 0
+	for {
+		err := q.client.LMove(ctx, redisProcessingKey, redisQueueKey, "RIGHT", "RIGHT").Err()
+		if errors.Is(err, redis.Nil) {
+			break
+		}
+		if err != nil {
+			slog.Error("Error recovering jobs from Redis processing list", "error", err)
+			break
+		}
+		recovered++
+	}
+	if recovered > 0 {
+		slog.Warn("Requeued webhooks left unfinished by a previous run", "count", recovered)
+	}
+}
+
+// Close stops the workers after their current job. Jobs still in the list
+// are left in Redis for the next start.
+func (q *redisQueue) Close() {
+	q.stop()
+	q.workers.Wait()
+}
+
+func (q *redisQueue) Done() <-chan struct{} {
+	return q.stopCtx.Done()
+}
+
+func (q *redisQueue) run() {
+	defer q.workers.Done()
+
+	for q.stopCtx.Err() == nil {
+		data, err := q.client.BLMove(q.stopCtx, redisQueueKey, redisProcessingKey, "RIGHT", "LEFT", time.Second).Result()
+		if errors.Is(err, redis.Nil) || q.stopCtx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			slog.Error("Error reading from Redis queue", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var job redisJob
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			slog.Error("Skipping malformed job in Redis queue", "error", err)
+		} else {
+			q.deliver(job)
+		}
+		q.done(data)
+	}
+}
+
+func (q *redisQueue) deliver(job redisJob) {
+	job.Webhook.RawBody = job.RawBody
+	ctx := extractTrace(contextWithRequestID(context.Background(), job.RequestID), job.Trace)
+	recordID := job.RecordID
+	if job.Host != q.host {
+		recordID = 0
+	}
+
+	if wasProcessed(ctx, job.Webhook) {
+		slog.InfoContext(ctx, "Skipping already processed queued webhook", webhookAttrs(job.Webhook)...)
+		recordSendResult(ctx, recordID, sendStatusDuplicate, nil)
+		return
+	}
+	deliverWebhook(ctx, job.Webhook, recordID)
+}
+
+// done removes a finished job from the processing list. It uses a fresh
+// context so jobs finishing during shutdown are still removed.
+func (q *redisQueue) done(data string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := q.client.LRem(ctx, redisProcessingKey, 1, data).Err(); err != nil {
+		slog.Error("Error removing job from Redis processing list", "error", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// webhookSchema describes the Pretix webhook payload. It is kept in Go
+// rather than a .json file so the Docker build, which copies only *.go, picks
+// it up. Unknown fields are allowed; STRICT_JSON rejects those.
+const webhookSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "Pretix webhook",
+	"type": "object",
+	"required": ["organizer", "event", "action"],
+	"properties": {
+		"notification_id": {"type": "integer", "minimum": 0},
+		"organizer": {"type": "string", "minLength": 1},
+		"event": {"type": "string", "minLength": 1},
+		"code": {"type": "string"},
+		"action": {"type": "string", "pattern": "^pretix\\."},
+		"status": {"type": "string"},
+		"email": {"type": "string"},
+		"total": {"type": ["string", "number"]},
+		"secret": {"type": "string"},
+		"refund_id": {"type": "integer", "minimum": 0},
+		"refund_amount": {"type": ["string", "number"]},
+		"refund_reason": {"type": "string"},
+		"created": {"type": "string", "format": "date-time"}
+	},
+	"if": {"properties": {"action": {"pattern": "^pretix\\.event\\.order\\."}}},
+	"then": {"required": ["code"], "properties": {"code": {"minLength": 1}}}
+}`
+
+// payloadSchema is compiled at startup when VALIDATE_SCHEMA is set.
+var payloadSchema *jsonschema.Schema
+
+func compileWebhookSchema() (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("pretix-webhook.json", strings.NewReader(webhookSchema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("pretix-webhook.json")
+}
+
+// schemaError lists the fields of a payload that don't match webhookSchema.
+type schemaError struct {
+	fields []string
+}
+
+func (e *schemaError) Error() string {
+	return "payload does not match schema: " + strings.Join(e.fields, "; ")
+}
+
+// validateSchema checks body against payloadSchema, returning a *schemaError
+// naming each offending field.
+func validateSchema(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+
+	err := payloadSchema.Validate(v)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+
+	// Only the leaves say what's wrong; their parents just report that a
+	// subschema failed.
+	var fields []string
+	var walk func(*jsonschema.ValidationError)
+	walk = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			location := strings.TrimPrefix(ve.InstanceLocation, "/")
+			if location == "" {
+				location = "(root)"
+			}
+			fields = append(fields, fmt.Sprintf("%s: %s", location, ve.Message))
+		}
+		for _, cause := range ve.Causes {
+			walk(cause)
+		}
+	}
+	walk(validationErr)
+	return &schemaError{fields: fields}
+}
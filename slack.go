@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// slackNotifier posts events to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+	httpClient *http.Client
+}
+
+func newSlackNotifier(webhookURL string, timeout time.Duration) *slackNotifier {
+	return &slackNotifier{
+		webhookURL: webhookURL,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func (n *slackNotifier) Name() string {
+	return notifierSlack
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(slackMessageFor(event))
+	if err != nil {
+		return fmt.Errorf("error encoding Slack message: %v", err)
+	}
+
+	if config.DryRun {
+		slog.InfoContext(ctx, "Dry run, Slack message not sent", append(webhookAttrs(event.Webhook), "payload", string(payload))...)
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting Slack message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d from Slack: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	slog.InfoContext(ctx, "Slack message posted successfully", webhookAttrs(event.Webhook)...)
+	return nil
+}
+
+// slackMessageFor renders the title in bold above the body, followed by a
+// context line identifying the event and order.
+func slackMessageFor(event Event) slackMessage {
+	webhook := event.Webhook
+	details := []string{slackEscape(webhook.Organizer + "/" + webhook.Event)}
+	if webhook.Code != "" {
+		details = append(details, "Order `"+slackEscape(webhook.Code)+"`")
+	}
+	if codes := event.Data["order_codes"]; codes != "" {
+		details = append(details, "Orders `"+slackEscape(codes)+"`")
+	}
+	if total := event.Data["total_formatted"]; total != "" {
+		details = append(details, slackEscape(total))
+	}
+
+	return slackMessage{
+		Text: event.Title + ": " + event.Body,
+		Blocks: []slackBlock{
+			{
+				Type: "section",
+				Text: &slackText{Type: "mrkdwn", Text: "*" + slackEscape(event.Title) + "*\n" + slackEscape(event.Body)},
+			},
+			{
+				Type:     "context",
+				Elements: []slackText{{Type: "mrkdwn", Text: strings.Join(details, " · ")}},
+			},
+		},
+	}
+}
+
+// slackEscape escapes the characters Slack treats as control sequences in
+// message text.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
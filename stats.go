@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are in-process webhook counters for deployments without Prometheus.
+// Counters are atomic; the per-action map is only write-locked the first
+// time an action is seen.
+type Stats struct {
+	started time.Time
+
+	received   atomic.Int64
+	sent       atomic.Int64
+	failed     atomic.Int64
+	duplicates atomic.Int64
+
+	mu       sync.RWMutex
+	byAction map[string]*actionStats
+}
+
+type actionStats struct {
+	received   atomic.Int64
+	sent       atomic.Int64
+	failed     atomic.Int64
+	duplicates atomic.Int64
+}
+
+var stats = newStats()
+
+func newStats() *Stats {
+	return &Stats{started: time.Now(), byAction: make(map[string]*actionStats)}
+}
+
+func (s *Stats) action(action string) *actionStats {
+	s.mu.RLock()
+	a, ok := s.byAction[action]
+	s.mu.RUnlock()
+	if ok {
+		return a
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok = s.byAction[action]; !ok {
+		a = &actionStats{}
+		s.byAction[action] = a
+	}
+	return a
+}
+
+func (s *Stats) Received(action string) {
+	s.received.Add(1)
+	s.action(action).received.Add(1)
+}
+
+func (s *Stats) Sent(action string) {
+	s.sent.Add(1)
+	s.action(action).sent.Add(1)
+}
+
+func (s *Stats) Failed(action string) {
+	s.failed.Add(1)
+	s.action(action).failed.Add(1)
+}
+
+func (s *Stats) Duplicate(action string) {
+	s.duplicates.Add(1)
+	s.action(action).duplicates.Add(1)
+}
+
+type statsCounts struct {
+	Received   int64 `json:"received"`
+	Sent       int64 `json:"sent"`
+	Failed     int64 `json:"failed"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+// StatsSnapshot is a point-in-time copy of Stats.
+type StatsSnapshot struct {
+	statsCounts
+	UptimeSeconds int64                  `json:"uptime_seconds"`
+	Actions       map[string]statsCounts `json:"actions"`
+}
+
+func (s *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		statsCounts: statsCounts{
+			Received:   s.received.Load(),
+			Sent:       s.sent.Load(),
+			Failed:     s.failed.Load(),
+			Duplicates: s.duplicates.Load(),
+		},
+		UptimeSeconds: int64(time.Since(s.started).Seconds()),
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot.Actions = make(map[string]statsCounts, len(s.byAction))
+	for action, a := range s.byAction {
+		snapshot.Actions[action] = statsCounts{
+			Received:   a.received.Load(),
+			Sent:       a.sent.Load(),
+			Failed:     a.failed.Load(),
+			Duplicates: a.duplicates.Load(),
+		}
+	}
+	return snapshot
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats.Snapshot())
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// WebhookStore persists received webhooks for auditing and debugging.
+type WebhookStore interface {
+	// Insert records a parsed webhook and its raw body, returning the
+	// stored record's ID.
+	Insert(ctx context.Context, webhook PretixWebhook, rawBody []byte, receivedAt time.Time) (int64, error)
+	// RecordResult stores the outcome of the FCM send for a record.
+	RecordResult(ctx context.Context, id int64, status string, sendErr error) error
+	// List returns stored webhooks matching filter, newest first, and the
+	// total number of matches.
+	List(ctx context.Context, filter WebhookFilter) ([]StoredWebhook, int, error)
+	// RawBody returns the body of the most recent webhook stored with
+	// notificationID, or sql.ErrNoRows.
+	RawBody(ctx context.Context, notificationID int) ([]byte, error)
+	Close() error
+}
+
+// WebhookFilter selects a page of stored webhooks. Empty fields match all.
+type WebhookFilter struct {
+	Action string
+	Event  string
+	Limit  int
+	Offset int
+}
+
+// StoredWebhook is a stored webhook with the outcome of its send.
+type StoredWebhook struct {
+	ID             int64     `json:"id"`
+	NotificationID int       `json:"notification_id"`
+	Organizer      string    `json:"organizer"`
+	Event          string    `json:"event"`
+	Action         string    `json:"action"`
+	Code           string    `json:"code"`
+	Status         string    `json:"status"`
+	ReceivedAt     time.Time `json:"received_at"`
+	SendStatus     string    `json:"send_status"`
+	SendError      string    `json:"send_error,omitempty"`
+}
+
+// Send statuses recorded for stored webhooks.
+const (
+	sendStatusPending   = "pending"
+	sendStatusSent      = "sent"
+	sendStatusFailed    = "failed"
+	sendStatusSkipped   = "skipped"
+	sendStatusDuplicate = "duplicate"
+	// sendStatusSuppressed marks webhooks dropped during quiet hours.
+	sendStatusSuppressed = "suppressed"
+)
+
+// sqliteStore is a WebhookStore backed by a SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const createWebhooksTable = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	notification_id INTEGER NOT NULL,
+	organizer       TEXT NOT NULL,
+	event           TEXT NOT NULL,
+	action          TEXT NOT NULL,
+	code            TEXT NOT NULL,
+	status          TEXT NOT NULL,
+	raw_body        TEXT NOT NULL,
+	received_at     TIMESTAMP NOT NULL,
+	send_status     TEXT NOT NULL DEFAULT 'pending',
+	send_error      TEXT NOT NULL DEFAULT ''
+)`
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	// SQLite only supports a single writer; serialize access to avoid
+	// "database is locked" errors under concurrent webhooks.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(createWebhooksTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating webhooks table: %v", err)
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Insert(ctx context.Context, webhook PretixWebhook, rawBody []byte, receivedAt time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO webhooks (notification_id, organizer, event, action, code, status, raw_body, received_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		webhook.NotificationID, webhook.Organizer, webhook.Event, webhook.Action,
+		webhook.Code, webhook.Status, string(rawBody), receivedAt.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error inserting webhook: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+func (s *sqliteStore) RecordResult(ctx context.Context, id int64, status string, sendErr error) error {
+	var errText string
+	if sendErr != nil {
+		errText = sendErr.Error()
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE webhooks SET send_status = ?, send_error = ? WHERE id = ?`,
+		status, errText, id)
+	if err != nil {
+		return fmt.Errorf("error recording send result: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) List(ctx context.Context, filter WebhookFilter) ([]StoredWebhook, int, error) {
+	where := "WHERE (? = '' OR action = ?) AND (? = '' OR event = ?)"
+	args := []any{filter.Action, filter.Action, filter.Event, filter.Event}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM webhooks "+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting webhooks: %v", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, notification_id, organizer, event, action, code, status, received_at, send_status, send_error
+		 FROM webhooks `+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	webhooks := []StoredWebhook{}
+	for rows.Next() {
+		var w StoredWebhook
+		if err := rows.Scan(&w.ID, &w.NotificationID, &w.Organizer, &w.Event, &w.Action, &w.Code,
+			&w.Status, &w.ReceivedAt, &w.SendStatus, &w.SendError); err != nil {
+			return nil, 0, fmt.Errorf("error reading webhook: %v", err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error listing webhooks: %v", err)
+	}
+	return webhooks, total, nil
+}
+
+func (s *sqliteStore) RawBody(ctx context.Context, notificationID int) ([]byte, error) {
+	var body string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT raw_body FROM webhooks WHERE notification_id = ? ORDER BY id DESC LIMIT 1`,
+		notificationID).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(body), nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Page sizes for the events endpoint.
+const (
+	defaultEventsLimit = 50
+	maxEventsLimit     = 500
+)
+
+// handleEvents lists stored webhooks with their send outcome, newest first.
+// It accepts limit (capped at 500), offset, action and event query parameters.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		writeJSONError(w, http.StatusNotFound, "Webhook store is not configured")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := WebhookFilter{
+		Action: query.Get("action"),
+		Event:  query.Get("event"),
+		Limit:  defaultEventsLimit,
+	}
+	var err error
+	if raw := query.Get("limit"); raw != "" {
+		if filter.Limit, err = strconv.Atoi(raw); err != nil || filter.Limit < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		filter.Limit = min(filter.Limit, maxEventsLimit)
+	}
+	if raw := query.Get("offset"); raw != "" {
+		if filter.Offset, err = strconv.Atoi(raw); err != nil || filter.Offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+
+	events, total, err := store.List(r.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing stored webhooks", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error listing events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"total":  total,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+}
+
+// handleReplayStored re-sends the notification for a stored webhook, e.g. to
+// check template changes against a real payload. Deduplication and action
+// filters are bypassed, and the outcome isn't recorded in the store.
+func handleReplayStored(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if store == nil {
+		writeJSONError(w, http.StatusNotFound, "Webhook store is not configured")
+		return
+	}
+
+	notificationID, err := strconv.Atoi(r.PathValue("notification_id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "notification_id must be an integer")
+		return
+	}
+
+	body, err := store.RawBody(ctx, notificationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No stored webhook with notification_id %d", notificationID))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading stored webhook", "notification_id", notificationID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error loading stored webhook")
+		return
+	}
+
+	webhook, err := parseWebhook(ctx, body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error parsing stored webhook", "notification_id", notificationID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error parsing stored webhook")
+		return
+	}
+
+	slog.InfoContext(ctx, "Replaying stored webhook", webhookAttrs(webhook)...)
+	ctx, sent := withMessageIDs(ctx)
+	if err := dispatch(ctx, webhook); err != nil {
+		slog.ErrorContext(ctx, "Error replaying stored webhook", append(webhookAttrs(webhook), "error", err)...)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to send notification: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":          "sent",
+		"notification_id": notificationID,
+		"message_ids":     sent.list(),
+	})
+}
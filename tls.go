@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// acmeManager obtains and renews certificates when ACME_HOSTS is set.
+var acmeManager *autocert.Manager
+
+// newTLSConfig builds the server's TLS settings from TLS_MIN_VERSION and
+// TLS_CIPHER_SUITES, with certificates from TLS_CERT_FILE/TLS_KEY_FILE or
+// ACME. It returns nil when TLS isn't configured.
+func newTLSConfig() (*tls.Config, error) {
+	acme := len(config.ACMEHosts) > 0
+	files := config.TLSCertFile != "" || config.TLSKeyFile != ""
+	switch {
+	case acme && files:
+		return nil, errors.New("ACME_HOSTS can't be combined with TLS_CERT_FILE and TLS_KEY_FILE")
+	case !acme && !files:
+		return nil, nil
+	case files && (config.TLSCertFile == "" || config.TLSKeyFile == ""):
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	minVersion, ok := tlsVersions[strings.TrimPrefix(config.TLSMinVersion, "TLS")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q, expected 1.0, 1.1, 1.2 or 1.3", config.TLSMinVersion)
+	}
+	tlsConfig := &tls.Config{MinVersion: minVersion}
+	if acme {
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.ACMEHosts...),
+			Cache:      autocert.DirCache(config.ACMECacheDir),
+			Email:      config.ACMEEmail,
+		}
+		tlsConfig = acmeManager.TLSConfig()
+		tlsConfig.MinVersion = minVersion
+	}
+
+	// Go doesn't allow configuring TLS 1.3 suites, so these only apply to
+	// 1.2 and below. Insecure suites must be named explicitly.
+	if len(config.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range config.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q in TLS_CIPHER_SUITES", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// newACMEHTTPServer answers ACME HTTP-01 challenges on ACME_HTTP_PORT and
+// redirects every other request to HTTPS.
+func newACMEHTTPServer() *http.Server {
+	return &http.Server{
+		Addr:              ":" + config.ACMEHTTPPort,
+		Handler:           acmeManager.HTTPHandler(http.HandlerFunc(redirectHTTPS)),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+	}
+}
+
+// redirectHTTPS answers with 308 so webhooks posted over HTTP are resent as
+// POSTs with their body.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if config.Port != "443" {
+		host = net.JoinHostPort(host, config.Port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// maxMulticastTokens is the FCM limit on tokens per multicast message.
+const maxMulticastTokens = 500
+
+// Bounds for the device token sanity check. Current FCM tokens are around
+// 160 characters; the limits leave room for the format to change.
+const (
+	minDeviceTokenLength = 32
+	maxDeviceTokenLength = 4096
+)
+
+// validateDeviceToken rejects strings that can't be FCM registration tokens,
+// such as pasted whitespace or a truncated token. It only checks length and
+// the URL-safe character set tokens are made of, so FCM remains the judge of
+// whether a token is actually registered.
+func validateDeviceToken(token string) error {
+	if len(token) < minDeviceTokenLength || len(token) > maxDeviceTokenLength {
+		return fmt.Errorf("device token must be %d to %d characters, got %d",
+			minDeviceTokenLength, maxDeviceTokenLength, len(token))
+	}
+	for i, c := range token {
+		isAlnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !isAlnum && !strings.ContainsRune("-_:.", c) {
+			return fmt.Errorf("device token contains invalid character %q at position %d", c, i)
+		}
+	}
+	return nil
+}
+
+// TokenStore holds the device tokens that receive every order notification,
+// along with the topics each token was subscribed to on registration.
+type TokenStore interface {
+	List() []string
+	Topics(token string) []string
+	Add(token string, topics []string) error
+	Delete(token string) error
+}
+
+// fileTokenStore keeps tokens in memory and, when backed by a file, writes
+// every change back to it so pruned tokens stay pruned across restarts.
+type fileTokenStore struct {
+	mu     sync.RWMutex
+	path   string
+	tokens map[string][]string
+}
+
+// newFileTokenStore seeds the store from FCM_DEVICE_TOKENS and, when set,
+// FCM_DEVICE_TOKENS_FILE. Each file line holds a token optionally followed by
+// a comma-separated topic list; lines starting with # are ignored.
+func newFileTokenStore(inline []string, path string) (*fileTokenStore, error) {
+	s := &fileTokenStore{path: path, tokens: make(map[string][]string)}
+	for _, token := range inline {
+		s.tokens[token] = nil
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening device token file: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var topics []string
+		if len(fields) > 1 {
+			topics = strings.Split(fields[1], ",")
+		}
+		s.tokens[fields[0]] = topics
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading device token file: %v", err)
+	}
+	return s, nil
+}
+
+func (s *fileTokenStore) List() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]string, 0, len(s.tokens))
+	for token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func (s *fileTokenStore) Topics(token string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.tokens[token]...)
+}
+
+func (s *fileTokenStore) Add(token string, topics []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[token] = append([]string(nil), topics...)
+	return s.save()
+}
+
+func (s *fileTokenStore) Delete(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[token]; !ok {
+		return nil
+	}
+	delete(s.tokens, token)
+	return s.save()
+}
+
+// save rewrites the token file. Callers must hold s.mu.
+func (s *fileTokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	lines := make([]string, 0, len(s.tokens))
+	for token, topics := range s.tokens {
+		line := token
+		if len(topics) > 0 {
+			line += " " + strings.Join(topics, ",")
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	data := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		data += "\n"
+	}
+	if err := os.WriteFile(s.path, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("error writing device token file: %v", err)
+	}
+	return nil
+}
+
+// directTokens returns the stored tokens that aren't subscribed to any topic.
+// Tokens registered with topics already receive notifications through them.
+func directTokens() []string {
+	var tokens []string
+	for _, token := range tokenStore.List() {
+		if len(tokenStore.Topics(token)) == 0 {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// sendToDevices delivers message to every direct device token using
+// multicast sends. Per-token failures are logged rather than returned so a
+// few stale tokens don't fail the whole webhook; tokens FCM reports as dead
+// are pruned from the token store.
+func sendToDevices(ctx context.Context, client *messaging.Client, message messaging.Message, webhook PretixWebhook) error {
+	tokens := directTokens()
+	var succeeded, failed int
+	var dead []string
+
+	for start := 0; start < len(tokens); start += maxMulticastTokens {
+		end := min(start+maxMulticastTokens, len(tokens))
+		batch := tokens[start:end]
+
+		if config.DryRun {
+			slog.InfoContext(ctx, "Dry run, FCM multicast message not sent", "message", loggableMessage(&message), "tokens", len(batch))
+			succeeded += len(batch)
+			continue
+		}
+
+		if retryAfter := fcmRetryAfter(); retryAfter > 0 {
+			return &fcmQuotaError{retryAfter: retryAfter}
+		}
+		release, err := acquireSendSlot(ctx)
+		if err != nil {
+			return err
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, config.FCMTimeout)
+		response, err := client.SendEachForMulticast(sendCtx, &messaging.MulticastMessage{
+			Tokens:       batch,
+			Data:         message.Data,
+			Notification: message.Notification,
+			Android:      message.Android,
+			APNS:         message.APNS,
+			FCMOptions:   message.FCMOptions,
+		})
+		cancel()
+		release()
+		trackFCMAuthFailure(ctx, err)
+		if err != nil {
+			recordFCMResult(ctx, err)
+		}
+		if isFCMQuotaError(err) {
+			return throttleFCM(ctx, err)
+		}
+		if err != nil {
+			return fmt.Errorf("error sending multicast message: %w", err)
+		}
+
+		succeeded += response.SuccessCount
+		failed += response.FailureCount
+		var sendErr error
+		for i, result := range response.Responses {
+			if result.Success {
+				recordMessageID(ctx, result.MessageID)
+				continue
+			}
+			slog.WarnContext(ctx, "FCM send to device token failed",
+				append(webhookAttrs(webhook), "token_index", start+i, "error", result.Error)...)
+			if isDeadTokenError(result.Error) {
+				dead = append(dead, batch[i])
+			} else {
+				sendErr = result.Error
+			}
+		}
+		// The alerter sees one result per batch. Dead tokens are the device's
+		// problem, not FCM's, so they count neither way.
+		if sendErr != nil || response.SuccessCount > 0 {
+			recordFCMResult(ctx, sendErr)
+		}
+	}
+
+	slog.InfoContext(ctx, "FCM multicast sent",
+		append(webhookAttrs(webhook), "succeeded", succeeded, "failed", failed)...)
+
+	pruneTokens(ctx, dead)
+	return nil
+}
+
+// isDeadTokenError reports whether a per-token send error means the token
+// will never work again. INVALID_ARGUMENT isn't one: FCM also returns it for
+// problems with the message itself, which would prune every token at once.
+func isDeadTokenError(err error) bool {
+	return messaging.IsUnregistered(err) || messaging.IsSenderIDMismatch(err)
+}
+
+func pruneTokens(ctx context.Context, tokens []string) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	pruned := 0
+	for _, token := range tokens {
+		if err := tokenStore.Delete(token); err != nil {
+			slog.ErrorContext(ctx, "Error pruning device token", "error", err)
+			continue
+		}
+		pruned++
+	}
+	slog.InfoContext(ctx, "Pruned dead device tokens", "pruned", pruned)
+}
+
+type registerRequest struct {
+	Token  string   `json:"token"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+func decodeRegisterRequest(w http.ResponseWriter, r *http.Request) (registerRequest, bool) {
+	var request registerRequest
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if isBodyTooLarge(err) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return request, false
+		}
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return request, false
+	}
+	if request.Token == "" {
+		writeJSONError(w, http.StatusBadRequest, "Device token is required")
+		return request, false
+	}
+	return request, true
+}
+
+// handleRegister stores a device token and subscribes it to the requested
+// topics.
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeRegisterRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.FCMTimeout)
+	defer cancel()
+
+	for _, topic := range request.Topics {
+		if config.DryRun {
+			slog.InfoContext(ctx, "Dry run, not subscribing device token to topic", "topic", topic)
+			continue
+		}
+		response, err := getFCMClient(defaultFCMProject).SubscribeToTopic(ctx, []string{request.Token}, topic)
+		if err == nil && response.FailureCount > 0 {
+			err = fmt.Errorf("%s", response.Errors[0].Reason)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error subscribing device token to topic", "topic", topic, "error", err)
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to subscribe to topic %s", topic))
+			return
+		}
+	}
+
+	if err := tokenStore.Add(request.Token, request.Topics); err != nil {
+		slog.ErrorContext(ctx, "Error storing device token", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to store device token")
+		return
+	}
+
+	slog.InfoContext(ctx, "Registered device token", "topics", request.Topics)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "registered",
+		"topics": request.Topics,
+	})
+}
+
+// handleUnregister unsubscribes a device token from its stored topics and
+// removes it from the token store.
+func handleUnregister(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeRegisterRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.FCMTimeout)
+	defer cancel()
+
+	for _, topic := range tokenStore.Topics(request.Token) {
+		if config.DryRun {
+			slog.InfoContext(ctx, "Dry run, not unsubscribing device token from topic", "topic", topic)
+			continue
+		}
+		if _, err := getFCMClient(defaultFCMProject).UnsubscribeFromTopic(ctx, []string{request.Token}, topic); err != nil {
+			slog.WarnContext(ctx, "Error unsubscribing device token from topic", "topic", topic, "error", err)
+		}
+	}
+
+	if err := tokenStore.Delete(request.Token); err != nil {
+		slog.ErrorContext(ctx, "Error removing device token", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to remove device token")
+		return
+	}
+
+	slog.InfoContext(ctx, "Unregistered device token")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "unregistered",
+	})
+}